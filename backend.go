@@ -0,0 +1,407 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// Backend is the storage engine behind a Store. It holds the charm
+// metadata and bundles, the charm events, the update locks and the
+// statistics counters. The Store implements the charm publishing and
+// serving logic on top of it.
+//
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	BlobStore
+
+	// InsertCharm records the charm described by doc. If any of the
+	// doc URLs already holds a charm with the same revision, the
+	// error ErrUpdateConflict is returned. If lockToken is not empty,
+	// the charm is only recorded if the update locks over all of the
+	// doc URLs are held with that token, and ErrUpdateConflict is
+	// returned otherwise. The charm must not be found by FindCharms
+	// or FindCharmsByReference before the locks are confirmed to be
+	// held.
+	InsertCharm(doc *CharmDoc, lockToken string) error
+
+	// FindCharms returns at most the last n revisions of the charm
+	// at url selected by filter, in descending revision order. If url
+	// has a revision, only that revision is considered. For n=0, all
+	// the matching revisions are returned.
+	FindCharms(url *charm.URL, n int, filter DeletedFilter) ([]*CharmDoc, error)
+
+	// FindCharmsByReference returns all the charms with a URL that
+	// matches ref in any series. Soft-deleted revisions are left out.
+	FindCharmsByReference(ref charm.Reference) ([]*CharmDoc, error)
+
+	// FindDeletedCharms returns all the revisions that were
+	// soft-deleted before the given time.
+	FindDeletedCharms(before time.Time) ([]*CharmDoc, error)
+
+	// SetCharmDeletion soft-deletes the given revision of the charm
+	// at url, which must not have a revision, recording the details
+	// in deletion. If deletion is nil, the revision is undeleted
+	// instead. If no such revision exists, the error ErrNotFound is
+	// returned.
+	SetCharmDeletion(url *charm.URL, revision int, deletion *CharmDeletion) error
+
+	// RemoveCharm removes the metadata for the given revision of the
+	// charm at url. The url must not have a revision.
+	RemoveCharm(url *charm.URL, revision int) error
+
+	// RefBlob increments the reference count of the blob holding
+	// data with the given SHA256 hash, and returns its id. If no such
+	// blob is known, the error ErrNotFound is returned.
+	RefBlob(sha256 string) (BlobId, error)
+
+	// InsertBlobRef records that the blob with the given id holds
+	// data with the given SHA256 hash, and has a single reference.
+	// If a blob is already recorded for the hash, the error
+	// ErrUpdateConflict is returned.
+	InsertBlobRef(sha256 string, id BlobId) error
+
+	// UnrefBlob decrements the reference count of the blob with the
+	// given id and SHA256 hash. Once no references are left the blob
+	// is forgotten, and removed is true. The blob data itself must
+	// then be removed by the caller. If the blob isn't known, the
+	// error ErrNotFound is returned.
+	//
+	// If token is not empty, the reference count is only decremented
+	// if it wasn't already decremented with the same token, so that
+	// the operation may be safely repeated. Tokens are remembered
+	// until the blob is forgotten.
+	UnrefBlob(sha256 string, id BlobId, token string) (removed bool, err error)
+
+	// BlobRefs returns the reference counts of all the known blobs.
+	BlobRefs() ([]*BlobRef, error)
+
+	// SetBlobRef records the reference count in ref, replacing any
+	// count previously known for ref.Sha256. If ref.Refs is zero,
+	// the blob is forgotten instead.
+	SetBlobRef(ref *BlobRef) error
+
+	// IterCharms calls f for each of the stored charms. If f returns
+	// an error, the iteration stops and that error is returned.
+	IterCharms(f func(doc *CharmDoc) error) error
+
+	// InsertDeleteIntent records intent as pending.
+	InsertDeleteIntent(intent *DeleteIntent) error
+
+	// DeleteIntents returns all the pending delete intents.
+	DeleteIntents() ([]*DeleteIntent, error)
+
+	// RemoveDeleteIntent removes intent once it has been applied.
+	RemoveDeleteIntent(intent *DeleteIntent) error
+
+	// InsertEvent records event.
+	InsertEvent(event *CharmEvent) error
+
+	// FindEvent returns the most recent event associated with url
+	// and digest. If digest is empty, any digest matches. If no
+	// event is found, the error ErrNotFound is returned.
+	FindEvent(url *charm.URL, digest string) (*CharmEvent, error)
+
+	// InsertLock records lock as held. If lock.Key is already locked,
+	// the error ErrUpdateConflict is returned.
+	InsertLock(lock *LockDoc) error
+
+	// RemoveLock unlocks key if it's locked with the given token.
+	RemoveLock(key, token string) error
+
+	// RenewLock records t as the time the lock over key was last
+	// renewed, provided it's locked with the given token. Otherwise
+	// the error ErrUpdateConflict is returned.
+	RenewLock(key, token string, t time.Time) error
+
+	// ExpireLock unlocks key if its lock was last renewed before the
+	// given time.
+	ExpireLock(key string, before time.Time) error
+
+	// BreakLock unlocks key no matter who holds its lock. If key
+	// isn't locked, the error ErrNotFound is returned.
+	BreakLock(key string) error
+
+	// Locks returns all the held update locks, ordered by key.
+	Locks() ([]*LockDoc, error)
+
+	// SyncTime returns the time recorded for the sync with the given
+	// name. If no time is recorded, the error ErrNotFound is returned.
+	SyncTime(name string) (time.Time, error)
+
+	// SetSyncTime records t as the time of the sync with the given
+	// name, replacing any time previously recorded.
+	SetSyncTime(name string, t time.Time) error
+
+	// InsertJob adds job to the publish queue.
+	InsertJob(job *PublishJob) error
+
+	// ClaimJob reserves to owner until lease the oldest job in the
+	// publish queue that is either pending or running with a lease
+	// that expired before now, and returns it in the running state.
+	// If there is no such job, the error ErrNotFound is returned.
+	ClaimJob(owner string, now, lease time.Time) (*PublishJob, error)
+
+	// UpdateJob records the state, lease, progress, outcome and update
+	// time of job, provided it's still running and reserved to
+	// job.Owner. Otherwise the error ErrUpdateConflict is returned.
+	UpdateJob(job *PublishJob) error
+
+	// FindJob returns the job in the publish queue with the given id.
+	// If no such job exists, the error ErrNotFound is returned.
+	FindJob(id string) (*PublishJob, error)
+
+	// FindJobs returns the jobs in the publish queue that are in any
+	// of the given states, oldest first.
+	FindJobs(states ...JobState) ([]*PublishJob, error)
+
+	// JobCounts returns the number of jobs in the publish queue in
+	// each state.
+	JobCounts() (map[JobState]int, error)
+
+	// IncCounter increases by one the counter for key at time t,
+	// which is rounded to the start of a minute.
+	IncCounter(key []string, t time.Time) error
+
+	// IncCounters applies all the counter increments in incs at once.
+	IncCounters(incs []CounterInc) error
+
+	// Counters aggregates counter values according to req. The
+	// result order is irrelevant, and unknown keys may be left out.
+	Counters(req *CounterRequest) ([]Counter, error)
+
+	// Close releases the resources held by the backend.
+	Close()
+}
+
+// LockDoc describes an update lock held over a charm URL.
+type LockDoc struct {
+	Key string `bson:"_id"`
+
+	// Owner identifies the process holding the lock.
+	Owner string
+
+	// Token uniquely identifies this acquisition of the lock.
+	Token string
+
+	// Acquired holds when the lock was acquired, and Time when it
+	// was last renewed.
+	Acquired time.Time
+	Time     time.Time
+}
+
+// WithBlobStore returns a Backend that keeps new charm bundles in
+// blobs, and everything else in backend. Bundles stored in backend
+// before blobs was put in place remain available.
+func WithBlobStore(backend Backend, blobs BlobStore) Backend {
+	return &blobBackend{backend, blobs}
+}
+
+type blobBackend struct {
+	Backend
+	blobs BlobStore
+}
+
+func (b *blobBackend) CreateBlob() (BlobWriter, error) {
+	return b.blobs.CreateBlob()
+}
+
+func (b *blobBackend) OpenBlob(id BlobId) (io.ReadCloser, error) {
+	r, err := b.blobs.OpenBlob(id)
+	if err == ErrNotFound {
+		return b.Backend.OpenBlob(id)
+	}
+	return r, err
+}
+
+func (b *blobBackend) RemoveBlob(id BlobId) error {
+	err := b.blobs.RemoveBlob(id)
+	if err == ErrNotFound {
+		return b.Backend.RemoveBlob(id)
+	}
+	return err
+}
+
+func (b *blobBackend) BlobIds() ([]BlobId, error) {
+	ids, err := b.blobs.BlobIds()
+	if err != nil {
+		return nil, err
+	}
+	oldIds, err := b.Backend.BlobIds()
+	if err != nil {
+		return nil, err
+	}
+	return append(ids, oldIds...), nil
+}
+
+// BlobStore holds the bundle data of stored charms.
+type BlobStore interface {
+	// CreateBlob returns a writer for a new blob. The blob is only
+	// stored once the writer is finished.
+	CreateBlob() (BlobWriter, error)
+
+	// OpenBlob opens the blob with the given id for reading. The
+	// returned reader should also implement io.Seeker, so that parts
+	// of the blob may be served efficiently.
+	OpenBlob(id BlobId) (io.ReadCloser, error)
+
+	// RemoveBlob removes the blob with the given id.
+	RemoveBlob(id BlobId) error
+
+	// BlobIds returns the ids of all the stored blobs.
+	BlobIds() ([]BlobId, error)
+}
+
+// BlobWriter is an io.Writer that streams data into a new blob.
+// Either Finish or Abort must be called once writing is done.
+type BlobWriter interface {
+	io.Writer
+
+	// Finish stores the written data and returns the id of the new
+	// blob. The sha256 parameter must hold the hex-encoded SHA256 hash
+	// of the written data.
+	Finish(sha256 string) (BlobId, error)
+
+	// Abort discards the written data.
+	Abort()
+}
+
+// BlobId identifies a blob in a BlobStore.
+//
+// Blob ids that hold the hex representation of a MongoDB ObjectId are
+// stored as such, so that charm documents referring to GridFS files
+// keep the same format.
+type BlobId string
+
+// GetBSON implements bson.Getter.
+func (id BlobId) GetBSON() (interface{}, error) {
+	if bson.IsObjectIdHex(string(id)) {
+		return bson.ObjectIdHex(string(id)), nil
+	}
+	return string(id), nil
+}
+
+// SetBSON implements bson.Setter.
+func (id *BlobId) SetBSON(raw bson.Raw) error {
+	var v interface{}
+	if err := raw.Unmarshal(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bson.ObjectId:
+		*id = BlobId(v.Hex())
+	case string:
+		*id = BlobId(v)
+	default:
+		return fmt.Errorf("invalid blob id: %#v", v)
+	}
+	return nil
+}
+
+// CharmDoc holds the metadata stored for a charm.
+type CharmDoc struct {
+	URLs     []*charm.URL
+	Revision int
+	Digest   string
+	Sha256   string
+	Size     int64
+	FileId   BlobId
+	Meta     *charm.Meta
+	Config   *charm.Config
+	Deleted  *CharmDeletion `bson:",omitempty"`
+
+	// Time holds when the charm revision was published. It's zero
+	// for revisions published before it was recorded.
+	Time time.Time
+}
+
+// CharmDeletion records who soft-deleted a charm revision, and when.
+type CharmDeletion struct {
+	By   string
+	Time time.Time
+}
+
+// DeletedFilter selects charm revisions by whether they are
+// soft-deleted.
+type DeletedFilter int
+
+const (
+	// ExcludeDeleted selects the revisions that aren't soft-deleted.
+	ExcludeDeleted DeletedFilter = iota
+
+	// OnlyDeleted selects the soft-deleted revisions.
+	OnlyDeleted
+
+	// IncludeDeleted selects all the revisions.
+	IncludeDeleted
+)
+
+// matches returns whether doc is selected by f.
+func (f DeletedFilter) matches(doc *CharmDoc) bool {
+	switch f {
+	case ExcludeDeleted:
+		return doc.Deleted == nil
+	case OnlyDeleted:
+		return doc.Deleted != nil
+	}
+	return true
+}
+
+// BlobRef holds the reference count of a blob, which holds data
+// with the given SHA256 hash.
+type BlobRef struct {
+	Sha256 string `bson:"_id"`
+	BlobId BlobId
+	Refs   int
+
+	// Unrefs holds the tokens of the pending operations that have
+	// already dropped a reference to the blob.
+	Unrefs []string `bson:",omitempty"`
+}
+
+// DeleteIntent records the deletion of charm revisions before it's
+// applied, so that it may be finished if interrupted.
+type DeleteIntent struct {
+	Id        string `bson:"_id"`
+	URL       *charm.URL
+	Revisions []*DeleteRevision
+	Time      time.Time
+}
+
+// DeleteRevision holds the details of a charm revision being deleted.
+type DeleteRevision struct {
+	Revision int
+	Sha256   string
+	BlobId   BlobId
+
+	// Time holds when the revision was published, which tells it
+	// apart from a revision with the same number published after it
+	// was deleted.
+	Time time.Time
+}
+
+// token returns the token used to drop the reference to the bundle
+// of rev. The token identifies the revision and its blob rather than
+// intent, so that the reference is dropped only once even if several
+// intents delete the same revision.
+func (intent *DeleteIntent) token(rev *DeleteRevision) string {
+	return fmt.Sprintf("%s-%d/%s/%d", intent.URL, rev.Revision, rev.BlobId, rev.Time.UnixNano())
+}
+
+// hasURL returns whether doc is available at url, which must not
+// have a revision.
+func (doc *CharmDoc) hasURL(url *charm.URL) bool {
+	for _, u := range doc.URLs {
+		if *u == *url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"labix.org/v2/mgo/bson"
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/store"
+)
+
+func (s *TrivialSuite) TestBlobIdBSON(c *gc.C) {
+	type doc struct {
+		FileId store.BlobId
+	}
+	oid := bson.NewObjectId()
+	tests := []struct {
+		id    store.BlobId
+		value interface{}
+	}{
+		{store.BlobId(oid.Hex()), oid},
+		{"3190955", "3190955"},
+	}
+	for _, t := range tests {
+		data, err := bson.Marshal(doc{t.id})
+		c.Assert(err, gc.IsNil)
+
+		// The stored value is an ObjectId when possible, to keep
+		// compatibility with documents referring to GridFS files.
+		var raw bson.M
+		err = bson.Unmarshal(data, &raw)
+		c.Assert(err, gc.IsNil)
+		c.Assert(raw["fileid"], gc.Equals, t.value)
+
+		var d doc
+		err = bson.Unmarshal(data, &d)
+		c.Assert(err, gc.IsNil)
+		c.Assert(d.FileId, gc.Equals, t.id)
+	}
+}
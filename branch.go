@@ -6,11 +6,10 @@ package store
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"regexp"
 
 	"launchpad.net/juju-core/charm"
 )
@@ -24,105 +23,99 @@ import (
 // revision id of the checked out branch's tip, though, which may
 // differ from the digest parameter.
 func PublishBazaarBranch(store *Store, urls []*charm.URL, burl string, digest string) error {
+	return Publish(store, urls, BazaarSource(burl), digest)
+}
 
-	// Prevent other publishers from updating these specific URLs
-	// concurrently.
-	lock, err := store.LockUpdates(urls)
-	if err != nil {
-		return err
-	}
-	defer lock.Unlock()
-
-	var branchDir string
-NewTip:
-	// Prepare the charm publisher. This will compute the revision
-	// to be assigned to the charm, and it will also fail if the
-	// operation is unnecessary because charms are up-to-date.
-	pub, err := store.CharmPublisher(urls, digest)
-	if err != nil {
-		return err
-	}
+// DryRunBazaarBranch checks out the Bazaar branch from burl and reports
+// what publishing it with PublishBazaarBranch would do, as DryRun does.
+func DryRunBazaarBranch(store *Store, urls []*charm.URL, burl string, digest string) (*DryRunResult, error) {
+	return DryRun(store, urls, BazaarSource(burl), digest)
+}
 
-	// Figure if publishing this charm was already attempted before and
-	// failed. We won't try again endlessly if so. In the future we may
-	// retry automatically in certain circumstances.
-	event, err := store.CharmEvent(urls[0], digest)
-	if err == nil && event.Kind != EventPublished {
-		return fmt.Errorf("charm publishing previously failed: %s", strings.Join(event.Errors, "; "))
-	} else if err != nil && err != ErrNotFound {
-		return err
-	}
+// PublishGitBranch clones the git repository from burl and publishes
+// the commit at its HEAD at urls in the given store. The digest
+// parameter must be the most recent known commit hash for HEAD, and is
+// handled the same way as by PublishBazaarBranch. The published digest
+// is the commit hash of the cloned HEAD.
+func PublishGitBranch(store *Store, urls []*charm.URL, burl string, digest string) error {
+	return Publish(store, urls, GitSource(burl), digest)
+}
 
-	if branchDir == "" {
-		// Retrieve the branch with a lightweight checkout, so that it
-		// builds a working tree as cheaply as possible. History
-		// doesn't matter here.
-		tempDir, err := ioutil.TempDir("", "publish-branch-")
-		if err != nil {
-			return err
-		}
-		defer os.RemoveAll(tempDir)
-		branchDir = filepath.Join(tempDir, "branch")
-		output, err := exec.Command("bzr", "checkout", "--lightweight", burl, branchDir).CombinedOutput()
-		if err != nil {
-			return outputErr(output, err)
-		}
-
-		// Pick actual digest from tip. Publishing the real tip
-		// revision rather than the revision for the digest provided is
-		// strictly necessary to prevent a race condition. If the
-		// provided digest was published instead, there's a chance
-		// another publisher concurrently running could have found a
-		// newer revision and published that first, and the digest
-		// parameter provided is in fact an old version that would
-		// overwrite the new version.
-		tipDigest, err := bzrRevisionId(branchDir)
-		if err != nil {
-			return err
-		}
-		if tipDigest != digest {
-			digest = tipDigest
-			goto NewTip
-		}
-	}
+// BazaarSource is a Source that retrieves charms from the Bazaar branch
+// at the given URL. The digest is the revision id of the branch tip.
+type BazaarSource string
+
+// Checkout implements Source.Checkout.
+func (src BazaarSource) Checkout(dir string) (digest string, err error) {
+	return src.CheckoutAbort(dir, nil)
+}
 
-	ch, err := charm.ReadDir(branchDir)
-	if err == nil {
-		// Hand over the charm to the store for bundling and
-		// streaming its content into the database.
-		err = pub.Publish(ch)
-		if err == ErrUpdateConflict {
-			// A conflict may happen in edge cases if the whole
-			// locking mechanism fails due to an expiration event,
-			// and then the expired concurrent publisher revives
-			// for whatever reason and attempts to finish
-			// publishing. The state of the system is still
-			// consistent in that case, and the error isn't logged
-			// since the revision was properly published before.
-			return err
-		}
+// CheckoutAbort implements AbortableSource.CheckoutAbort.
+func (src BazaarSource) CheckoutAbort(dir string, abort <-chan struct{}) (digest string, err error) {
+	// Retrieve the branch with a lightweight checkout, so that it
+	// builds a working tree as cheaply as possible. History
+	// doesn't matter here.
+	cmd := exec.Command("bzr", "checkout", "--lightweight", string(src), dir)
+	output, err := runCommand(cmd, abort)
+	if err == ErrAborted {
+		return "", err
+	} else if err != nil {
+		return "", checkoutErr(output, err)
 	}
+	return bzrRevisionId(dir)
+}
+
+// GitSource is a Source that retrieves charms from the git repository
+// at the given URL. The digest is the commit hash of HEAD.
+type GitSource string
 
-	// Publishing is done. Log failure or error.
-	event = &CharmEvent{
-		URLs:   urls,
-		Digest: digest,
+// Checkout implements Source.Checkout.
+func (src GitSource) Checkout(dir string) (digest string, err error) {
+	return src.CheckoutAbort(dir, nil)
+}
+
+// CheckoutAbort implements AbortableSource.CheckoutAbort.
+func (src GitSource) CheckoutAbort(dir string, abort <-chan struct{}) (digest string, err error) {
+	// Retrieve the repository with a shallow clone, as history
+	// doesn't matter here.
+	cmd := exec.Command("git", "clone", "--quiet", "--depth", "1", string(src), dir)
+	output, err := runCommand(cmd, abort)
+	if err == ErrAborted {
+		return "", err
+	} else if err != nil {
+		return "", checkoutErr(output, err)
 	}
-	if err == nil {
-		event.Kind = EventPublished
-		event.Revision = pub.Revision()
-	} else {
-		event.Kind = EventPublishError
-		event.Errors = []string{err.Error()}
+	digest, err = gitRevisionId(dir)
+	if err != nil {
+		return "", err
 	}
-	if logerr := store.LogCharmEvent(event); logerr != nil {
-		if err == nil {
-			err = logerr
-		} else {
-			err = fmt.Errorf("%v; %v", err, logerr)
-		}
+	// The repository metadata must not end up in the bundle.
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", err
 	}
-	return err
+	return digest, nil
+}
+
+// gitRevisionId returns the commit hash of HEAD in the git repository
+// in branchDir.
+func gitRevisionId(branchDir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = branchDir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		output = append(output, '\n')
+		output = append(output, stderr.Bytes()...)
+		return "", transient(outputErr(output, err))
+	}
+	fields := bytes.Fields(output)
+	if len(fields) != 1 {
+		output = append(output, '\n')
+		output = append(output, stderr.Bytes()...)
+		return "", fmt.Errorf(`invalid output from "git rev-parse HEAD": %s`, output)
+	}
+	return string(fields[0]), nil
 }
 
 // bzrRevisionId returns the Bazaar revision id for the branch in branchDir.
@@ -135,7 +128,7 @@ func bzrRevisionId(branchDir string) (string, error) {
 	if err != nil {
 		output = append(output, '\n')
 		output = append(output, stderr.Bytes()...)
-		return "", outputErr(output, err)
+		return "", transient(outputErr(output, err))
 	}
 	pair := bytes.Fields(output)
 	if len(pair) != 2 {
@@ -146,6 +139,45 @@ func bzrRevisionId(branchDir string) (string, error) {
 	return string(pair[1]), nil
 }
 
+// missingBranch matches the output of bzr and git when the branch or
+// repository to retrieve doesn't exist.
+var missingBranch = regexp.MustCompile(`(?m)^bzr: ERROR: Not a branch|does not exist|does not appear to be a git repository|^fatal: repository '.*' not found`)
+
+// checkoutErr returns the error for a checkout that failed with the
+// given output and err. The failure is transient unless the branch
+// doesn't exist, as trying again won't fix that.
+func checkoutErr(output []byte, err error) error {
+	err = outputErr(output, err)
+	if missingBranch.Match(output) {
+		return err
+	}
+	return transient(err)
+}
+
+// runCommand runs cmd and returns its combined output. If abort is
+// closed before cmd completes, the command is killed and ErrAborted is
+// returned.
+func runCommand(cmd *exec.Cmd, abort <-chan struct{}) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return output.Bytes(), err
+	case <-abort:
+		cmd.Process.Kill()
+		<-done
+		return nil, ErrAborted
+	}
+}
+
 // outputErr returns an error that assembles some command's output and its
 // error, if both output and err are set, and returns only err if output is nil.
 func outputErr(output []byte, err error) error {
@@ -125,7 +125,7 @@ func (s *StoreSuite) TestPublish(c *gc.C) {
 		c.Assert(event.Kind, gc.Equals, store.EventPublished)
 		c.Assert(event.Revision, gc.Equals, i)
 		c.Assert(event.Errors, gc.IsNil)
-		c.Assert(event.Warnings, gc.IsNil)
+		c.Assert(event.Warnings, gc.DeepEquals, dummyLintWarnings)
 	}
 }
 
@@ -164,6 +164,152 @@ func (s *StoreSuite) TestPublishErrorInCharm(c *gc.C) {
 	c.Assert(event.Errors, gc.NotNil)
 	c.Assert(event.Errors[0], gc.Matches, ".*/metadata.yaml: no such file or directory")
 	c.Assert(event.Warnings, gc.IsNil)
+
+	// Errors in the charm aren't retried.
+	c.Assert(event.Transient, gc.Equals, false)
+	c.Assert(event.Attempts, gc.HasLen, 1)
+}
+
+func (s *StoreSuite) dummyGitBranch(c *gc.C) gitDir {
+	branch := gitDir(c.MkDir())
+	branch.init()
+
+	copyCharmDir(branch.path(), testing.Charms.Dir("dummy"))
+	branch.add(".")
+	branch.commit("Imported charm.")
+	return branch
+}
+
+func (s *StoreSuite) TestPublishGit(c *gc.C) {
+	branch := s.dummyGitBranch(c)
+
+	err := store.PublishGitBranch(s.store, urls, branch.url(), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+
+	for _, url := range urls {
+		info, rc, err := s.store.OpenCharm(url)
+		c.Assert(err, gc.IsNil)
+		defer rc.Close()
+		c.Assert(info.Revision(), gc.Equals, 0)
+		c.Assert(info.Digest(), gc.Equals, branch.digest())
+
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, gc.IsNil)
+
+		bundle, err := charm.ReadBundleBytes(data)
+		c.Assert(err, gc.IsNil)
+		c.Assert(bundle.Revision(), gc.Equals, 0)
+		c.Assert(bundle.Meta().Name, gc.Equals, "dummy")
+	}
+
+	// The real commit is picked from the repository, and it was
+	// published already.
+	err = store.PublishGitBranch(s.store, urls, branch.url(), "wrong-rev")
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+
+	// Lying about the tip prevents the new commit from being seen.
+	digest1 := branch.digest()
+	branch.change()
+	err = store.PublishGitBranch(s.store, urls, branch.url(), digest1)
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+
+	err = store.PublishGitBranch(s.store, urls, branch.url(), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	digest2 := branch.digest()
+
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 1)
+
+	_, err = s.store.CharmEvent(urls[0], "wrong-rev")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	for i, digest := range []string{digest1, digest2} {
+		event, err := s.store.CharmEvent(urls[0], digest)
+		c.Assert(err, gc.IsNil)
+		c.Assert(event.Kind, gc.Equals, store.EventPublished)
+		c.Assert(event.Revision, gc.Equals, i)
+	}
+}
+
+func (s *StoreSuite) TestPublishGitErrorInCharm(c *gc.C) {
+	branch := s.dummyGitBranch(c)
+
+	// Corrupt the charm.
+	branch.remove("metadata.yaml")
+	branch.commit("Removed metadata.yaml.")
+
+	err := store.PublishGitBranch(s.store, urls, branch.url(), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, ".*/metadata.yaml: no such file or directory")
+
+	event, err := s.store.CharmEvent(urls[0], branch.digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublishError)
+	c.Assert(event.Errors[0], gc.Matches, ".*/metadata.yaml: no such file or directory")
+
+	// Publishing isn't attempted again for the same commit.
+	err = store.PublishGitBranch(s.store, urls, branch.url(), branch.digest())
+	c.Assert(err, gc.ErrorMatches, "charm publishing previously failed: .*")
+}
+
+func (s *StoreSuite) TestPublishGitErrorFromGit(c *gc.C) {
+	err := store.PublishGitBranch(s.store, urls, "file://"+c.MkDir()+"/missing", "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, "(?s)exit status .*")
+
+	// The repository won't appear by trying again.
+	c.Assert(store.IsTransient(err), gc.Equals, false)
+}
+
+type gitDir string
+
+func (dir gitDir) path(args ...string) string {
+	return filepath.Join(append([]string{string(dir)}, args...)...)
+}
+
+// url returns the URL of the repository, which allows shallow clones.
+func (dir gitDir) url() string {
+	return "file://" + string(dir)
+}
+
+func (dir gitDir) run(args ...string) []byte {
+	// Avoid depending on the git configuration of the user.
+	args = append([]string{"-c", "user.name=nobody", "-c", "user.email=nobody@testing.invalid"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = string(dir)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		panic(fmt.Sprintf("command failed: git %s\n%s", strings.Join(args, " "), output))
+	}
+	return output
+}
+
+func (dir gitDir) init() {
+	dir.run("init", "--quiet")
+}
+
+func (dir gitDir) add(paths ...string) {
+	dir.run(append([]string{"add"}, paths...)...)
+}
+
+func (dir gitDir) remove(paths ...string) {
+	dir.run(append([]string{"rm", "--quiet"}, paths...)...)
+}
+
+func (dir gitDir) commit(msg string) {
+	dir.run("commit", "--quiet", "-m", msg)
+}
+
+func (dir gitDir) change() {
+	t := time.Now().String()
+	err := ioutil.WriteFile(dir.path("timestamp"), []byte(t), 0644)
+	if err != nil {
+		panic(err)
+	}
+	dir.add("timestamp")
+	dir.commit("Revision bumped at " + t)
+}
+
+func (dir gitDir) digest() string {
+	return strings.TrimSpace(string(dir.run("rev-parse", "HEAD")))
 }
 
 type bzrDir string
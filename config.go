@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"launchpad.net/goyaml"
 )
@@ -14,6 +15,66 @@ import (
 type Config struct {
 	MongoURL string `yaml:"mongo-url"`
 	APIAddr  string `yaml:"api-addr"`
+	BlobDir  string `yaml:"blob-dir"`
+
+	// PurgeAge holds how long soft-deleted charms are kept before
+	// they may be purged, in the format accepted by time.ParseDuration.
+	PurgeAge string `yaml:"purge-age"`
+
+	// PublishWorkers holds the maximum number of Launchpad branches
+	// published concurrently.
+	PublishWorkers int `yaml:"publish-workers"`
+
+	// BranchTimeout holds how long publishing a single Launchpad
+	// branch may take, in the format accepted by time.ParseDuration.
+	BranchTimeout string `yaml:"branch-timeout"`
+
+	// FatalLintChecks holds the names of the lint checks that prevent
+	// charms from being published, rather than just causing warnings.
+	FatalLintChecks []string `yaml:"fatal-lint-checks"`
+
+	// BundlePolicy holds the policy charm bundles must comply with
+	// to be published.
+	BundlePolicy BundlePolicy `yaml:"bundle-policy"`
+
+	// UserBundlePolicies holds the policies for charms owned by
+	// specific users, which replace BundlePolicy for them.
+	UserBundlePolicies map[string]BundlePolicy `yaml:"user-bundle-policies"`
+}
+
+// DefaultPurgeAge is how long soft-deleted charms are kept when the
+// configuration doesn't say otherwise.
+const DefaultPurgeAge = 30 * 24 * time.Hour
+
+// PurgeAgeDuration returns the age after which soft-deleted charms
+// may be purged, as configured in PurgeAge.
+func (conf *Config) PurgeAgeDuration() (time.Duration, error) {
+	if conf.PurgeAge == "" {
+		return DefaultPurgeAge, nil
+	}
+	age, err := time.ParseDuration(conf.PurgeAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid purge-age: %v", err)
+	}
+	return age, nil
+}
+
+// DistroParams returns the parameters for publishing Launchpad branches
+// with PublishCharmsDistroWith, as configured in PublishWorkers and
+// BranchTimeout.
+func (conf *Config) DistroParams() (DistroParams, error) {
+	params := DistroParams{Workers: conf.PublishWorkers}
+	if params.Workers < 0 {
+		return DistroParams{}, fmt.Errorf("invalid publish-workers: %d", conf.PublishWorkers)
+	}
+	if conf.BranchTimeout != "" {
+		timeout, err := time.ParseDuration(conf.BranchTimeout)
+		if err != nil {
+			return DistroParams{}, fmt.Errorf("invalid branch-timeout: %v", err)
+		}
+		params.BranchTimeout = timeout
+	}
+	return params, nil
 }
 
 func ReadConfig(path string) (*Config, error) {
@@ -31,5 +92,60 @@ func ReadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("processing config file: %v", err)
 	}
+	if _, err := conf.PurgeAgeDuration(); err != nil {
+		return nil, fmt.Errorf("processing config file: %v", err)
+	}
+	if _, err := conf.DistroParams(); err != nil {
+		return nil, fmt.Errorf("processing config file: %v", err)
+	}
+	if err := checkLintNames(conf.FatalLintChecks); err != nil {
+		return nil, fmt.Errorf("processing config file: %v", err)
+	}
 	return conf, nil
 }
+
+// OpenConfig opens the store described by conf. If conf.BlobDir is
+// set, charm bundles are kept as files in that directory, and only
+// their metadata is stored in MongoDB. The store purges soft-deleted
+// charms once they are older than conf.PurgeAge.
+func OpenConfig(conf *Config) (*Store, error) {
+	age, err := conf.PurgeAgeDuration()
+	if err != nil {
+		return nil, err
+	}
+	store, err := openConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SetFatalLintChecks(conf.FatalLintChecks); err != nil {
+		store.Close()
+		return nil, err
+	}
+	store.SetBundlePolicy(conf.BundlePolicy)
+	for user, policy := range conf.UserBundlePolicies {
+		store.SetUserBundlePolicy(user, policy)
+	}
+	store.StartPurging(age)
+	return store, nil
+}
+
+func openConfig(conf *Config) (*Store, error) {
+	if conf.BlobDir == "" {
+		return Open(conf.MongoURL)
+	}
+	blobs, err := NewFSBlobStore(conf.BlobDir)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("store opened, connecting to: %s", conf.MongoURL)
+	backend, err := NewMongoBackend(conf.MongoURL)
+	if err != nil {
+		return nil, err
+	}
+	store, err := New(WithBlobStore(backend, blobs))
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return store, nil
+}
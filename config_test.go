@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	gc "launchpad.net/gocheck"
 
@@ -22,6 +23,17 @@ var _ = gc.Suite(&ConfigSuite{})
 
 const testConfig = `
 mongo-url: localhost:23456
+blob-dir: /var/lib/charmstore/blobs
+purge-age: 168h
+publish-workers: 8
+branch-timeout: 20m
+fatal-lint-checks: [readme, interfaces]
+bundle-policy:
+  max-size: 1048576
+  forbid-binaries: true
+user-bundle-policies:
+  trusted:
+    max-size: 10485760
 foo: 1
 bar: false
 `
@@ -47,4 +59,44 @@ func (s *ConfigSuite) TestReadConfig(c *gc.C) {
 	dstr, err := store.ReadConfig(cfgPath)
 	c.Assert(err, gc.IsNil)
 	c.Assert(dstr.MongoURL, gc.Equals, "localhost:23456")
+	c.Assert(dstr.BlobDir, gc.Equals, "/var/lib/charmstore/blobs")
+	age, err := dstr.PurgeAgeDuration()
+	c.Assert(err, gc.IsNil)
+	c.Assert(age, gc.Equals, 7*24*time.Hour)
+	params, err := dstr.DistroParams()
+	c.Assert(err, gc.IsNil)
+	c.Assert(params.Workers, gc.Equals, 8)
+	c.Assert(params.BranchTimeout, gc.Equals, 20*time.Minute)
+	c.Assert(dstr.FatalLintChecks, gc.DeepEquals, []string{"readme", "interfaces"})
+	c.Assert(dstr.BundlePolicy, gc.Equals, store.BundlePolicy{MaxSize: 1 << 20, ForbidBinaries: true})
+	c.Assert(dstr.UserBundlePolicies, gc.DeepEquals, map[string]store.BundlePolicy{
+		"trusted": {MaxSize: 10 << 20},
+	})
+}
+
+func (s *ConfigSuite) TestPurgeAgeDuration(c *gc.C) {
+	conf := &store.Config{}
+	age, err := conf.PurgeAgeDuration()
+	c.Assert(err, gc.IsNil)
+	c.Assert(age, gc.Equals, store.DefaultPurgeAge)
+
+	conf.PurgeAge = "forever"
+	_, err = conf.PurgeAgeDuration()
+	c.Assert(err, gc.ErrorMatches, "invalid purge-age: .*")
+}
+
+func (s *ConfigSuite) TestDistroParams(c *gc.C) {
+	conf := &store.Config{}
+	params, err := conf.DistroParams()
+	c.Assert(err, gc.IsNil)
+	c.Assert(params, gc.DeepEquals, store.DistroParams{})
+
+	conf.PublishWorkers = -1
+	_, err = conf.DistroParams()
+	c.Assert(err, gc.ErrorMatches, "invalid publish-workers: -1")
+
+	conf.PublishWorkers = 0
+	conf.BranchTimeout = "a while"
+	_, err = conf.DistroParams()
+	c.Assert(err, gc.ErrorMatches, "invalid branch-timeout: .*")
 }
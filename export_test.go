@@ -3,4 +3,139 @@
 
 package store
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
 var TimeToStamp = timeToStamp
+
+func StoreBackend(s *Store) Backend {
+	return s.backend
+}
+
+func CharmInfoBlobId(info *CharmInfo) BlobId {
+	return info.fileId
+}
+
+func DeleteIntentToken(intent *DeleteIntent, rev *DeleteRevision) string {
+	return intent.token(rev)
+}
+
+func RetryDelay(s RetryStrategy, retry int) time.Duration {
+	return s.delay(retry)
+}
+
+// CountersMapReduce computes counters like s.Counters does, but with
+// the map-reduce implementation that preceded the aggregation pipeline,
+// so that both may be compared. It's only available for MongoDB
+// backends; ok is false otherwise.
+func CountersMapReduce(s *Store, req *CounterRequest) (counters []Counter, ok bool, err error) {
+	backend := s.backend
+	if b, isBlob := backend.(*blobBackend); isBlob {
+		backend = b.Backend
+	}
+	b, ok := backend.(*mongoBackend)
+	if !ok {
+		return nil, false, nil
+	}
+	counters, err = b.countersMapReduce(req)
+	if err != nil {
+		return nil, true, err
+	}
+	if !req.List && len(counters) == 0 {
+		counters = []Counter{{Key: req.Key, Prefix: req.Prefix, Count: 0}}
+	} else if len(counters) > 1 {
+		sort.Sort(sortableCounters(counters))
+	}
+	return counters, true, nil
+}
+
+func (b *mongoBackend) countersMapReduce(req *CounterRequest) ([]Counter, error) {
+	session := b.session.Copy()
+	defer session.Close()
+
+	searchKey, err := b.statsKey(session, req.Key, false)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// This reduce function simply sums, for each emitted key, all the values found under it.
+	job := mgo.MapReduce{Reduce: "function(key, values) { return Array.sum(values); }"}
+	var emit string
+	switch req.By {
+	case ByDay:
+		emit = "emit(k+'@'+NumberInt(this.t/86400), this.c);"
+	case ByWeek:
+		emit = "emit(k+'@'+NumberInt(this.t/604800), this.c);"
+	default:
+		emit = "emit(k, this.c);"
+	}
+	if req.List && req.Prefix {
+		job.Scope = bson.D{{"searchKeyLen", len(searchKey)}}
+		job.Map = fmt.Sprintf(`
+			function() {
+				var k = this.k;
+				var i = k.indexOf(':', searchKeyLen)+1;
+				if (k.length > i)  { k = k.substr(0, i)+'*'; }
+				%s
+			}`, emit)
+	} else {
+		emitKey := searchKey
+		if req.Prefix {
+			emitKey += "*"
+		}
+		job.Scope = bson.D{{"emitKey", emitKey}}
+		job.Map = fmt.Sprintf(`
+			function() {
+				var k = emitKey;
+				%s
+			}`, emit)
+	}
+
+	var result []struct {
+		Key   string `bson:"_id"`
+		Value int64
+	}
+	_, err = session.StatCounters().Find(countersQuery(req, searchKey)).MapReduce(&job, &result)
+	if err != nil {
+		return nil, err
+	}
+	var counters []Counter
+	for _, r := range result {
+		key := r.Key
+		var when time.Time
+		if req.By != ByAll {
+			at := strings.Index(key, "@")
+			if at == -1 {
+				return nil, fmt.Errorf("internal error: bad aggregated key: %q", r.Key)
+			}
+			stamp, err := strconv.ParseInt(key[at+1:], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("internal error: bad aggregated key: %q", r.Key)
+			}
+			key = key[:at]
+			when = stampPeriodTime(req.By, stamp)
+		}
+		tokens, err := b.statsKeyTokens(session, key)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, Counter{
+			Key:    tokens,
+			Prefix: strings.HasSuffix(key, "*"),
+			Count:  r.Value,
+			Time:   when,
+		})
+	}
+	return counters, nil
+}
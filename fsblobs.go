@@ -0,0 +1,165 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// fsBlobStore is a BlobStore that keeps blobs as files in a directory
+// tree. Each blob is identified by the hex-encoded SHA256 hash of its
+// content followed by a unique suffix, and is stored at
+//
+//	<dir>/<first two hash digits>/<hash>-<suffix>
+//
+// The suffix makes every blob a distinct file even when the content is
+// the same, so that removing a blob never affects another one that was
+// just written with the same content.
+//
+// Blobs being written are kept in temporary files inside dir, so
+// that they can be atomically moved into place once finished.
+type fsBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore returns a BlobStore that keeps blobs as files
+// under dir, which is created if necessary.
+func NewFSBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create blob directory: %v", err)
+	}
+	return &fsBlobStore{dir}, nil
+}
+
+// path returns the path of the file holding the blob with the given id.
+func (s *fsBlobStore) path(id BlobId) (string, error) {
+	i := strings.Index(string(id), "-")
+	if i != 64 || !bson.IsObjectIdHex(string(id[i+1:])) {
+		return "", ErrNotFound
+	}
+	if _, err := hex.DecodeString(string(id[:i])); err != nil {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.dir, string(id[:2]), string(id)), nil
+}
+
+// CreateBlob implements BlobStore.CreateBlob.
+func (s *fsBlobStore) CreateBlob() (BlobWriter, error) {
+	file, err := ioutil.TempFile(s.dir, "tmp-blob-")
+	if err != nil {
+		logger.Errorf("failed to create blob file: %v", err)
+		return nil, err
+	}
+	logger.Infof("creating blob file %s...", file.Name())
+	return &fsBlobWriter{s, file}, nil
+}
+
+// OpenBlob implements BlobStore.OpenBlob.
+func (s *fsBlobStore) OpenBlob(id BlobId) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// RemoveBlob implements BlobStore.RemoveBlob.
+func (s *fsBlobStore) RemoveBlob(id BlobId) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// BlobIds implements BlobStore.BlobIds.
+func (s *fsBlobStore) BlobIds() ([]BlobId, error) {
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []BlobId
+	for _, dir := range dirs {
+		// Skip temporary files of blobs being written.
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			id := BlobId(file.Name())
+			if _, err := s.path(id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// fsBlobWriter is a BlobWriter that writes into a temporary file
+// which is moved into the blob tree when finished.
+type fsBlobWriter struct {
+	store *fsBlobStore
+	file  *os.File
+}
+
+func (w *fsBlobWriter) Write(data []byte) (n int, err error) {
+	return w.file.Write(data)
+}
+
+func (w *fsBlobWriter) Finish(sha256 string) (BlobId, error) {
+	// Once renamed into place, removing the temporary file is a no-op.
+	defer os.Remove(w.file.Name())
+	err := w.file.Sync()
+	if err == nil {
+		err = w.file.Close()
+	} else {
+		w.file.Close()
+	}
+	if err != nil {
+		logger.Errorf("failed to close blob file: %v", err)
+		return "", err
+	}
+	id := BlobId(sha256 + "-" + bson.NewObjectId().Hex())
+	path, err := w.store.path(id)
+	if err != nil {
+		return "", fmt.Errorf("invalid blob hash: %q", sha256)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(w.file.Name(), path); err != nil {
+		logger.Errorf("failed to move blob file into place: %v", err)
+		return "", err
+	}
+	return id, nil
+}
+
+func (w *fsBlobWriter) Abort() {
+	// Ignore errors. Already aborting due to a preceding bad
+	// situation elsewhere.
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
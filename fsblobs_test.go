@@ -0,0 +1,164 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/charm"
+	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
+)
+
+var _ = gc.Suite(&FSBlobStoreSuite{})
+
+// FSBlobStoreSuite runs all the StoreSuite tests against a store
+// that keeps charm bundles in the filesystem.
+type FSBlobStoreSuite struct {
+	StoreSuite
+	blobDir string
+}
+
+func (s *FSBlobStoreSuite) SetUpTest(c *gc.C) {
+	s.BaseSuite.SetUpTest(c)
+	s.MgoSuite.SetUpTest(c)
+	s.HTTPSuite.SetUpTest(c)
+	s.PatchValue(&store.PublishRetryStrategy, fastRetryStrategy)
+	s.blobDir = c.MkDir()
+	blobs, err := store.NewFSBlobStore(s.blobDir)
+	c.Assert(err, gc.IsNil)
+	backend, err := store.NewMongoBackend(testing.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	s.store, err = store.New(store.WithBlobStore(backend, blobs))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *FSBlobStoreSuite) TestBundleFileLayout(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+
+	// The bundle is stored under its hash, and no temporary
+	// files are left behind.
+	info, err := s.store.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	id := string(store.CharmInfoBlobId(info))
+	c.Assert(id, gc.Matches, fakeRevZeroSha+"-[0-9a-f]{24}")
+	path := filepath.Join(s.blobDir, fakeRevZeroSha[:2], id)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "charm-revision-0")
+	entries, err := ioutil.ReadDir(s.blobDir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].Name(), gc.Equals, fakeRevZeroSha[:2])
+
+	_, err = s.store.DeleteCharm(url)
+	c.Assert(err, gc.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *TrivialSuite) TestFSBlobStore(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "blobs")
+	blobs, err := store.NewFSBlobStore(dir)
+	c.Assert(err, gc.IsNil)
+
+	content := "some blob content"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	w, err := blobs.CreateBlob()
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write([]byte(content))
+	c.Assert(err, gc.IsNil)
+	id, err := w.Finish(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(id), gc.Matches, hash+"-[0-9a-f]{24}")
+
+	rc, err := blobs.OpenBlob(id)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	// Aborted blobs leave nothing behind.
+	w, err = blobs.CreateBlob()
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write([]byte("aborted"))
+	c.Assert(err, gc.IsNil)
+	w.Abort()
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+
+	// Blobs with the same content are still distinct.
+	w, err = blobs.CreateBlob()
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write([]byte(content))
+	c.Assert(err, gc.IsNil)
+	id2, err := w.Finish(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id2, gc.Not(gc.Equals), id)
+	ids, err := blobs.BlobIds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ids, gc.HasLen, 2)
+
+	err = blobs.RemoveBlob(id)
+	c.Assert(err, gc.IsNil)
+	_, err = blobs.OpenBlob(id)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	rc, err = blobs.OpenBlob(id2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	err = blobs.RemoveBlob(id)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// Ids that aren't hashes are never found.
+	_, err = blobs.OpenBlob("../../etc/passwd")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	_, err = blobs.OpenBlob(store.BlobId(hash))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *FSBlobStoreSuite) TestGridFSBundlesRemainAvailable(c *gc.C) {
+	// Publish a charm before the blob directory is in use.
+	backend, err := store.NewMongoBackend(testing.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	st, err := store.New(backend)
+	c.Assert(err, gc.IsNil)
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	pub, err := st.CharmPublisher([]*charm.URL{url}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	st.Close()
+
+	info, rc, err := s.store.OpenCharm(url)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	c.Assert(string(data), gc.Equals, "charm-revision-0")
+	c.Assert(info.BundleSha256(), gc.Equals, fakeRevZeroSha)
+
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Orphans, gc.HasLen, 0)
+	c.Assert(report.Missing, gc.HasLen, 0)
+
+	_, err = s.store.DeleteCharm(url)
+	c.Assert(err, gc.IsNil)
+	_, err = store.StoreBackend(s.store).OpenBlob(store.CharmInfoBlobId(info))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
@@ -0,0 +1,278 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// The names of the checks run by Lint.
+const (
+	LintReadme     = "readme"
+	LintIcon       = "icon"
+	LintConfig     = "config"
+	LintHooks      = "hooks"
+	LintSize       = "size"
+	LintInterfaces = "interfaces"
+)
+
+// LintChecks holds the names of all the checks run by Lint.
+var LintChecks = []string{LintReadme, LintIcon, LintConfig, LintHooks, LintSize, LintInterfaces}
+
+// LintMaxSize is the total size of the charm files above which the
+// LintSize check reports a problem.
+var LintMaxSize int64 = 10 << 20
+
+// LintProblem is a problem found in a charm by one of the lint checks.
+type LintProblem struct {
+	Check   string
+	Message string
+}
+
+func (p LintProblem) String() string {
+	return p.Check + ": " + p.Message
+}
+
+// Lint runs all the lint checks on the charm in dir, and returns the
+// problems found.
+func Lint(dir *charm.Dir) ([]LintProblem, error) {
+	l := &linter{dir: dir}
+	for _, check := range []func() error{
+		l.checkReadme,
+		l.checkIcon,
+		l.checkConfig,
+		l.checkHooks,
+		l.checkSize,
+		l.checkInterfaces,
+	} {
+		if err := check(); err != nil {
+			return nil, err
+		}
+	}
+	return l.problems, nil
+}
+
+// checkLintNames returns an error if any of names isn't the name of a
+// lint check.
+func checkLintNames(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, check := range LintChecks {
+			known = known || name == check
+		}
+		if !known {
+			return fmt.Errorf("unknown lint check %q", name)
+		}
+	}
+	return nil
+}
+
+type linter struct {
+	dir      *charm.Dir
+	problems []LintProblem
+}
+
+func (l *linter) addf(check, format string, args ...interface{}) {
+	l.problems = append(l.problems, LintProblem{check, fmt.Sprintf(format, args...)})
+}
+
+// names returns the names of the files in the charm directory.
+func (l *linter) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(l.dir.Path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+func (l *linter) checkReadme() error {
+	names, err := l.names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(strings.ToLower(name), "readme") {
+			return nil
+		}
+	}
+	l.addf(LintReadme, "no README file found")
+	return nil
+}
+
+func (l *linter) checkIcon() error {
+	_, err := os.Stat(filepath.Join(l.dir.Path, "icon.svg"))
+	if os.IsNotExist(err) {
+		l.addf(LintIcon, "no icon.svg file found")
+		return nil
+	}
+	return err
+}
+
+// configGetPattern matches config-get invocations in hooks, with the
+// option name as the first group.
+var configGetPattern = regexp.MustCompile(`config-get(?:\s+--format[= ]\S+)?\s+['"]?([a-zA-Z0-9_][a-zA-Z0-9_-]*)`)
+
+func (l *linter) checkConfig() error {
+	options := l.dir.Config().Options
+	return l.walkHooks(func(name string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(filepath.Join(l.dir.Path, "hooks", name))
+		if err != nil {
+			return err
+		}
+		reported := make(map[string]bool)
+		for _, m := range configGetPattern.FindAllSubmatch(data, -1) {
+			option := string(m[1])
+			if _, ok := options[option]; !ok && !reported[option] {
+				l.addf(LintConfig, "hook %s uses undeclared config option %q", name, option)
+				reported[option] = true
+			}
+		}
+		return nil
+	})
+}
+
+func (l *linter) checkHooks() error {
+	hooks := l.hookNames()
+	return l.walkHooks(func(name string, info os.FileInfo) error {
+		if hooks[name] && info.Mode().IsRegular() && info.Mode()&0100 == 0 {
+			l.addf(LintHooks, "hook %s is not executable", name)
+		}
+		return nil
+	})
+}
+
+// hookNames returns the names of the hooks the charm may implement.
+func (l *linter) hookNames() map[string]bool {
+	hooks := map[string]bool{
+		"install":        true,
+		"start":          true,
+		"stop":           true,
+		"upgrade-charm":  true,
+		"config-changed": true,
+	}
+	meta := l.dir.Meta()
+	for _, relations := range []map[string]charm.Relation{meta.Provides, meta.Requires, meta.Peers} {
+		for name := range relations {
+			for _, kind := range []string{"joined", "changed", "departed", "broken"} {
+				hooks[name+"-relation-"+kind] = true
+			}
+		}
+	}
+	return hooks
+}
+
+// walkHooks calls f for each of the files in the hooks directory,
+// in name order.
+func (l *linter) walkHooks(f func(name string, info os.FileInfo) error) error {
+	infos, err := ioutil.ReadDir(filepath.Join(l.dir.Path, "hooks"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := f(info.Name(), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linter) checkSize() error {
+	var size int64
+	err := filepath.Walk(l.dir.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && vcsDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if size > LintMaxSize {
+		l.addf(LintSize, "charm files take %d bytes, more than the recommended %d", size, LintMaxSize)
+	}
+	return nil
+}
+
+// interfacePattern matches well formed interface names.
+var interfacePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+func (l *linter) checkInterfaces() error {
+	meta := l.dir.Meta()
+	var names []string
+	interfaces := make(map[string]string)
+	for _, relations := range []map[string]charm.Relation{meta.Provides, meta.Requires, meta.Peers} {
+		for name, rel := range relations {
+			names = append(names, name)
+			interfaces[name] = rel.Interface
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if iface := interfaces[name]; !interfacePattern.MatchString(iface) {
+			l.addf(LintInterfaces, "relation %s has badly named interface %q", name, iface)
+		}
+	}
+	return nil
+}
+
+// lint runs the lint checks on the charm in dir, and returns the
+// problems found as warnings. If any of the problems was found by a
+// check configured as fatal with SetFatalLintChecks, an error is
+// returned instead.
+func (s *Store) lint(dir *charm.Dir) (warnings []string, err error) {
+	problems, err := Lint(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fatal []string
+	for _, problem := range problems {
+		if s.fatalLint[problem.Check] {
+			fatal = append(fatal, problem.String())
+		} else {
+			warnings = append(warnings, problem.String())
+		}
+	}
+	if fatal != nil {
+		return nil, invalidCharm(fmt.Errorf("charm failed lint checks: %s", strings.Join(fatal, "; ")))
+	}
+	return warnings, nil
+}
+
+// SetFatalLintChecks makes the problems found by the named lint checks
+// prevent charms from being published, rather than being recorded as
+// warnings in the charm event.
+func (s *Store) SetFatalLintChecks(checks []string) error {
+	if err := checkLintNames(checks); err != nil {
+		return err
+	}
+	s.fatalLint = make(map[string]bool)
+	for _, check := range checks {
+		s.fatalLint[check] = true
+	}
+	return nil
+}
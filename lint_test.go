@@ -0,0 +1,121 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/charm"
+	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
+)
+
+// dummyLintWarnings holds the warnings recorded when publishing the
+// dummy testing charm.
+var dummyLintWarnings = []string{
+	"readme: no README file found",
+	"icon: no icon.svg file found",
+}
+
+const lintMetadata = `
+name: lintme
+summary: A charm with problems.
+description: A charm with problems.
+provides:
+  website:
+    interface: http
+requires:
+  db:
+    interface: My_SQL
+`
+
+// lintCharm returns a copy of the dummy charm with metadata replaced
+// by lintMetadata, and with a README and an icon.
+func lintCharm(c *gc.C) string {
+	dir := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	for name, data := range map[string]string{
+		"metadata.yaml": lintMetadata,
+		"README":        "Read me.",
+		"icon.svg":      "<svg/>",
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		c.Assert(err, gc.IsNil)
+	}
+	return dir
+}
+
+func (s *TrivialSuite) TestLint(c *gc.C) {
+	path := lintCharm(c)
+	dir, err := charm.ReadDir(path)
+	c.Assert(err, gc.IsNil)
+	problems, err := store.Lint(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(problems, gc.DeepEquals, []store.LintProblem{
+		{Check: store.LintInterfaces, Message: `relation db has badly named interface "My_SQL"`},
+	})
+
+	err = os.Remove(filepath.Join(path, "README"))
+	c.Assert(err, gc.IsNil)
+	err = os.Remove(filepath.Join(path, "icon.svg"))
+	c.Assert(err, gc.IsNil)
+	err = os.Chmod(filepath.Join(path, "hooks", "install"), 0644)
+	c.Assert(err, gc.IsNil)
+	hook := "#!/bin/sh\nconfig-get title\nconfig-get --format=json 'nonsense'\nconfig-get nonsense\n"
+	err = ioutil.WriteFile(filepath.Join(path, "hooks", "db-relation-joined"), []byte(hook), 0755)
+	c.Assert(err, gc.IsNil)
+	// Files other than hooks may not be executable.
+	err = ioutil.WriteFile(filepath.Join(path, "hooks", "common.sh"), nil, 0644)
+	c.Assert(err, gc.IsNil)
+
+	defer func(size int64) {
+		store.LintMaxSize = size
+	}(store.LintMaxSize)
+	store.LintMaxSize = 10
+
+	dir, err = charm.ReadDir(path)
+	c.Assert(err, gc.IsNil)
+	problems, err = store.Lint(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(problems, gc.HasLen, 6)
+	c.Assert(problems[0].String(), gc.Equals, "readme: no README file found")
+	c.Assert(problems[1].String(), gc.Equals, "icon: no icon.svg file found")
+	c.Assert(problems[2].String(), gc.Equals, `config: hook db-relation-joined uses undeclared config option "nonsense"`)
+	c.Assert(problems[3].String(), gc.Equals, "hooks: hook install is not executable")
+	c.Assert(problems[4].String(), gc.Matches, "size: charm files take [0-9]+ bytes, more than the recommended 10")
+	c.Assert(problems[5].String(), gc.Equals, `interfaces: relation db has badly named interface "My_SQL"`)
+}
+
+func (s *StoreSuite) TestPublishLint(c *gc.C) {
+	path := lintCharm(c)
+	err := store.Publish(s.store, urls, store.DirSource(path), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	event, err := s.store.CharmEvent(urls[0], info.Digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+	c.Assert(event.Warnings, gc.DeepEquals, []string{`interfaces: relation db has badly named interface "My_SQL"`})
+
+	err = s.store.SetFatalLintChecks([]string{"bogus"})
+	c.Assert(err, gc.ErrorMatches, `unknown lint check "bogus"`)
+	err = s.store.SetFatalLintChecks([]string{store.LintInterfaces, store.LintReadme})
+	c.Assert(err, gc.IsNil)
+
+	// Fatal problems prevent publishing.
+	err = ioutil.WriteFile(filepath.Join(path, "timestamp"), []byte("now"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = store.Publish(s.store, urls, store.DirSource(path), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, `charm failed lint checks: interfaces: relation db has badly named interface "My_SQL"`)
+	info, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	event, err = s.store.CharmEvent(urls[0], "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, false)
+}
@@ -6,8 +6,10 @@ package store
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"labix.org/v2/mgo/bson"
 	"launchpad.net/lpad"
 
 	"launchpad.net/juju-core/charm"
@@ -24,14 +26,66 @@ func (errs PublishBranchErrors) Error() string {
 	return fmt.Sprintf("%d branch(es) failed to be published", len(errs))
 }
 
+// DistroParams holds parameters for PublishCharmsDistroWith.
+type DistroParams struct {
+	// Workers holds the maximum number of branches published
+	// concurrently, and the number of queue workers started to
+	// publish them. If zero, DefaultDistroWorkers is used.
+	Workers int
+
+	// BranchTimeout holds how long publishing a single branch may
+	// take before it's given up on. If zero, there's no limit.
+	BranchTimeout time.Duration
+
+	// FullSync causes all the branches to be examined, rather than
+	// only those changed since the last successful sync.
+	FullSync bool
+
+	// Abort, if not nil, interrupts publishing when closed. Branches
+	// being published at the time are left in the publish queue, and
+	// no further branches are published.
+	Abort <-chan struct{}
+
+	// DryRun causes branches to be examined as DryRun does, rather
+	// than published. The sync isn't recorded as done in that case.
+	DryRun bool
+
+	// DryRunReport, if not nil, is called with the result for each
+	// branch that would be published in a dry run, in the order the
+	// branches were reported by Launchpad.
+	DryRunReport func(result *DryRunResult)
+}
+
+// DefaultDistroWorkers is the number of branches published concurrently
+// by PublishCharmsDistro.
+const DefaultDistroWorkers = 4
+
 // PublishCharmsDistro publishes all branch tips found in
 // the /charms distribution in Launchpad onto store under
-// the "cs:" scheme.
+// the "cs:" scheme. Only branches changed since the last
+// successful run against the same apiBase are examined.
 // apiBase specifies the Launchpad base API URL, such
 // as lpad.Production or lpad.Staging.
 // Errors found while processing one or more branches are
 // all returned as a PublishBranchErrors value.
 func PublishCharmsDistro(store *Store, apiBase lpad.APIBase) error {
+	return PublishCharmsDistroWith(store, apiBase, DistroParams{})
+}
+
+// PublishCharmsDistroWith is like PublishCharmsDistro, but publishes
+// branches as described by params. Branches are published concurrently
+// through the publish queue of the store, by the queue workers started
+// for the sync and any others consuming the queue, and branches that
+// share charm URLs are serialized by the store update locks. Errors in
+// the returned PublishBranchErrors are in the order the branches were
+// reported by Launchpad, no matter the order in which they happened.
+// If params.Abort is closed, ErrAborted is returned.
+//
+// Once all the branches changed since the last sync are examined, the
+// sync is recorded as done as of its start, unless some branch failed
+// to be published in a way that may be fixed by trying again, or the
+// branches were only examined in a dry run.
+func PublishCharmsDistroWith(store *Store, apiBase lpad.APIBase, params DistroParams) error {
 	oauth := &lpad.OAuth{Anonymous: true, Consumer: "juju"}
 	root, err := lpad.Login(apiBase, oauth)
 	if err != nil {
@@ -41,25 +95,58 @@ func PublishCharmsDistro(store *Store, apiBase lpad.APIBase) error {
 	if err != nil {
 		return err
 	}
-	tips, err := distro.BranchTips(time.Time{})
+	syncName := "launchpad:" + string(apiBase)
+	var since time.Time
+	if !params.FullSync {
+		since, err = store.SyncTime(syncName)
+		if err != nil {
+			return err
+		}
+	}
+	// Changes made while the sync is running must be picked by the
+	// next run, so the sync is recorded as of this moment.
+	start := time.Now()
+	tips, err := distro.BranchTips(since)
 	if err != nil {
 		return err
 	}
 
-	var errs PublishBranchErrors
-	for _, tip := range tips {
+	workers := params.Workers
+	if workers <= 0 {
+		workers = DefaultDistroWorkers
+	}
+	var queue []*QueueWorker
+	if !params.DryRun {
+		for i := 0; i < workers; i++ {
+			queue = append(queue, NewQueueWorker(store, "launchpad-sync-"+bson.NewObjectId().Hex()))
+		}
+		defer func() {
+			for _, w := range queue {
+				w.Stop()
+			}
+		}()
+	}
+	// Each branch records its error, if any, at its own index, so that
+	// errors may be reported in a predictable order.
+	results := make([]*PublishBranchError, len(tips))
+	dryRuns := make([]*DryRunResult, len(tips))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	aborted := false
+Tips:
+	for i, tip := range tips {
 		if !strings.HasSuffix(tip.UniqueName, "/trunk") {
 			continue
 		}
 		burl, curl, err := uniqueNameURLs(tip.UniqueName)
 		if err != nil {
-			errs = append(errs, PublishBranchError{tip.UniqueName, err})
+			results[i] = &PublishBranchError{tip.UniqueName, err}
 			logger.Errorf("%v", err)
 			continue
 		}
 		logger.Infof("%s\n", burl)
 		if tip.Revision == "" {
-			errs = append(errs, PublishBranchError{burl, fmt.Errorf("branch has no revisions")})
+			results[i] = &PublishBranchError{burl, fmt.Errorf("branch has no revisions")}
 			logger.Errorf("branch has no revisions\n")
 			continue
 		}
@@ -77,13 +164,61 @@ func PublishCharmsDistro(store *Store, apiBase lpad.APIBase) error {
 			urls = append(urls, curl)
 		}
 
-		err = PublishBazaarBranch(store, urls, burl, tip.Revision)
-		if err == ErrRedundantUpdate {
-			continue
+		// Wait for a free worker.
+		select {
+		case sem <- struct{}{}:
+		case <-params.Abort:
+			aborted = true
+			break Tips
 		}
-		if err != nil {
-			errs = append(errs, PublishBranchError{burl, err})
-			logger.Errorf("%v", err)
+		wg.Add(1)
+		go func(i int, burl string, urls []*charm.URL, digest string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result, err := publishBranch(store, queue, urls, burl, digest, params)
+			dryRuns[i] = result
+			if err != nil && err != ErrRedundantUpdate {
+				results[i] = &PublishBranchError{burl, err}
+				if err != ErrAborted {
+					logger.Errorf("%v", err)
+				}
+			}
+		}(i, burl, urls, tip.Revision)
+	}
+	wg.Wait()
+
+	var errs PublishBranchErrors
+	retry := false
+	for _, result := range results {
+		if result != nil {
+			aborted = aborted || result.Err == ErrAborted
+			retry = retry || IsTransient(result.Err)
+			errs = append(errs, *result)
+		}
+	}
+	if aborted {
+		return ErrAborted
+	}
+	if params.DryRun {
+		for _, result := range dryRuns {
+			if result == nil {
+				continue
+			}
+			logger.Infof("dry run: would publish %v at revision %d with digest %q and bundle sha256 %s",
+				result.URLs, result.Revision, result.Digest, result.Sha256)
+			if params.DryRunReport != nil {
+				params.DryRunReport(result)
+			}
+		}
+	}
+	// Branches that failed permanently have the failure logged as an
+	// event, and won't be published until they change again, so they
+	// don't have to be examined in the next run.
+	if !retry && !params.DryRun {
+		if err := store.SetSyncTime(syncName, start); err != nil {
+			return err
 		}
 	}
 	if errs != nil {
@@ -92,6 +227,63 @@ func PublishCharmsDistro(store *Store, apiBase lpad.APIBase) error {
 	return nil
 }
 
+// publishBranch publishes the Bazaar branch at burl through the
+// publish queue, waking up the given queue workers so that the job is
+// run right away, or examines it as DryRunBazaarBranch does if
+// params.DryRun is set. It gives up when params.Abort is closed or
+// params.BranchTimeout elapses.
+func publishBranch(store *Store, queue []*QueueWorker, urls []*charm.URL, burl, digest string, params DistroParams) (*DryRunResult, error) {
+	if !params.DryRun {
+		src := JobSource{Kind: SourceBazaar, Location: burl}
+		job, err := store.enqueuePublish(urls, src, digest, params.BranchTimeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range queue {
+			w.Wake()
+		}
+		job, err = store.waitJob(job.Id, params.Abort)
+		if err != nil {
+			return nil, err
+		}
+		if job.State != JobDone && job.State != JobFailed {
+			return nil, ErrAborted
+		}
+		return nil, job.Err()
+	}
+	run := func(opts publishOptions) (*DryRunResult, error) {
+		return dryRun(store, urls, BazaarSource(burl), digest, opts)
+	}
+	if params.BranchTimeout == 0 {
+		return run(publishOptions{abort: params.Abort})
+	}
+	abort := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	timedOut := false
+	timer := time.NewTimer(params.BranchTimeout)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C:
+			timedOut = true
+		case <-params.Abort:
+		case <-done:
+			return
+		}
+		close(abort)
+	}()
+	result, err := run(publishOptions{abort: abort})
+	if err == ErrAborted {
+		// The goroutine is done with timedOut once abort is closed.
+		<-abort
+		if timedOut {
+			return nil, transient(fmt.Errorf("publishing timed out after %v", params.BranchTimeout))
+		}
+	}
+	return result, err
+}
+
 // uniqueNameURLs returns the branch URL and the charm URL for the
 // provided Launchpad branch unique name. The unique name must be
 // in the form:
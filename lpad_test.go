@@ -5,6 +5,7 @@ package store_test
 
 import (
 	"fmt"
+	"time"
 
 	gc "launchpad.net/gocheck"
 	"launchpad.net/lpad"
@@ -70,4 +71,151 @@ func (s *StoreSuite) TestPublishCharmDistro(c *gc.C) {
 
 	// Request must be signed by juju.
 	c.Assert(req.Header.Get("Authorization"), gc.Matches, `.*oauth_consumer_key="juju".*`)
+
+	// The branch that failed doesn't exist, which trying again won't
+	// fix, so the sync is recorded as done.
+	t, err := s.store.SyncTime("launchpad:" + testing.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.IsZero(), gc.Equals, false)
+}
+
+func (s *StoreSuite) TestPublishCharmDistroIncremental(c *gc.C) {
+	branch := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+	apiBase := lpad.APIBase(testing.Server.URL)
+	before := time.Now()
+
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	data := fmt.Sprintf(`[["file://%s", "rev1", []]]`, branch.path())
+	testing.Server.Response(200, jsonType, []byte(data))
+	err := store.PublishCharmsDistro(s.store, apiBase)
+	c.Assert(err, gc.IsNil)
+	testing.Server.WaitRequest()
+	req := testing.Server.WaitRequest()
+	c.Assert(req.Form["since"], gc.IsNil)
+
+	synced, err := s.store.SyncTime("launchpad:" + testing.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(synced.Before(before), gc.Equals, false)
+
+	// The next run only asks for branches changed since then.
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	testing.Server.Response(200, jsonType, []byte("[]"))
+	err = store.PublishCharmsDistro(s.store, apiBase)
+	c.Assert(err, gc.IsNil)
+	testing.Server.WaitRequest()
+	req = testing.Server.WaitRequest()
+	c.Assert(req.Form["since"], gc.HasLen, 1)
+
+	t, err := s.store.SyncTime("launchpad:" + testing.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.After(synced), gc.Equals, true)
+
+	// A full sync may be forced.
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	testing.Server.Response(200, jsonType, []byte(data))
+	err = store.PublishCharmsDistroWith(s.store, apiBase, store.DistroParams{FullSync: true})
+	c.Assert(err, gc.IsNil)
+	testing.Server.WaitRequest()
+	req = testing.Server.WaitRequest()
+	c.Assert(req.Form["since"], gc.IsNil)
+}
+
+func (s *StoreSuite) TestPublishCharmDistroTimeout(c *gc.C) {
+	branch1 := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+	branch2 := s.dummyBranch(c, "~jeff/charms/precise/dummy/trunk")
+
+	// Make bzr hang until killed.
+	plugin := fakePlugin{}
+	plugin.install(c.MkDir(), `import time; time.sleep(30)`)
+	defer plugin.uninstall()
+
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	data := fmt.Sprintf(`[["file://%s", "rev1", []], ["file://%s", "rev2", []]]`, branch1.path(), branch2.path())
+	testing.Server.Response(200, jsonType, []byte(data))
+
+	apiBase := lpad.APIBase(testing.Server.URL)
+	params := store.DistroParams{Workers: 2, BranchTimeout: 200 * time.Millisecond}
+	err := store.PublishCharmsDistroWith(s.store, apiBase, params)
+	c.Assert(err, gc.ErrorMatches, `2 branch\(es\) failed to be published`)
+
+	// Errors are in the order the branches were listed.
+	errs := err.(store.PublishBranchErrors)
+	c.Assert(errs[0].URL, gc.Equals, "file://"+branch1.path())
+	c.Assert(errs[1].URL, gc.Equals, "file://"+branch2.path())
+	for _, berr := range errs {
+		c.Assert(berr.Err, gc.ErrorMatches, "publishing timed out after 200ms")
+	}
+
+	// Nothing was logged, so publishing is attempted again next time.
+	_, err = s.store.CharmEvent(charm.MustParseURL("cs:~joe/oneiric/dummy"), "rev1")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestPublishCharmDistroAbort(c *gc.C) {
+	branch := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+
+	plugin := fakePlugin{}
+	plugin.install(c.MkDir(), `import time; time.sleep(30)`)
+	defer plugin.uninstall()
+
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	data := fmt.Sprintf(`[["file://%s", "rev1", []]]`, branch.path())
+	testing.Server.Response(200, jsonType, []byte(data))
+
+	abort := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(abort)
+	}()
+	apiBase := lpad.APIBase(testing.Server.URL)
+	err := store.PublishCharmsDistroWith(s.store, apiBase, store.DistroParams{Abort: abort})
+	c.Assert(err, gc.Equals, store.ErrAborted)
+
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:~joe/oneiric/dummy"))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestPublishCharmDistroDryRun(c *gc.C) {
+	branch := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+
+	testing.Server.Response(200, jsonType, []byte("{}"))
+	data := fmt.Sprintf(`[`+
+		`["file://%s", "rev1", ["oneiric"]],`+
+		`["file:///non-existent/~jeff/charms/precise/bad/trunk", "rev2", []]`+
+		`]`,
+		branch.path())
+	testing.Server.Response(200, jsonType, []byte(data))
+
+	var results []*store.DryRunResult
+	params := store.DistroParams{
+		DryRun: true,
+		DryRunReport: func(result *store.DryRunResult) {
+			results = append(results, result)
+		},
+	}
+	apiBase := lpad.APIBase(testing.Server.URL)
+	err := store.PublishCharmsDistroWith(s.store, apiBase, params)
+	c.Assert(err, gc.ErrorMatches, `1 branch\(es\) failed to be published`)
+
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].URLs, gc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~joe/oneiric/dummy"),
+		charm.MustParseURL("cs:oneiric/dummy"),
+	})
+	c.Assert(results[0].Digest, gc.Equals, branch.digest())
+	c.Assert(results[0].Revision, gc.Equals, 0)
+	c.Assert(results[0].Sha256, gc.HasLen, 64)
+
+	// Nothing was published, logged or recorded.
+	for _, url := range results[0].URLs {
+		_, err = s.store.CharmInfo(url)
+		c.Assert(err, gc.Equals, store.ErrNotFound)
+		_, err = s.store.CharmEvent(url, "")
+		c.Assert(err, gc.Equals, store.ErrNotFound)
+	}
+	_, err = s.store.CharmEvent(charm.MustParseURL("cs:~jeff/precise/bad"), "")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	t, err := s.store.SyncTime("launchpad:" + testing.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.IsZero(), gc.Equals, true)
 }
@@ -0,0 +1,687 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// NewMemStore returns a new *Store that keeps all of its data in memory.
+// It behaves like a store backed by MongoDB, and is mainly useful for
+// testing code that depends on a store without running a database.
+func NewMemStore() (*Store, error) {
+	return New(newMemBackend())
+}
+
+// memBackend is a Backend that keeps all the store data in memory.
+type memBackend struct {
+	mu       sync.Mutex
+	charms   []*CharmDoc
+	events   []*CharmEvent
+	locks    map[string]*LockDoc
+	blobs    map[BlobId][]byte
+	blobRefs map[string]*BlobRef
+	lastBlob int
+	intents  []*DeleteIntent
+	syncs    map[string]time.Time
+	jobs     []*PublishJob
+	counters map[memCounterKey]int64
+}
+
+// memCounterKey identifies the counter for a key at a given time.
+// The key words are joined by memKeySep.
+type memCounterKey struct {
+	key   string
+	stamp int32
+}
+
+const memKeySep = "\x00"
+
+// Statically ensure that *memBackend is indeed a Backend.
+var _ Backend = (*memBackend)(nil)
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		locks:    make(map[string]*LockDoc),
+		blobs:    make(map[BlobId][]byte),
+		blobRefs: make(map[string]*BlobRef),
+		syncs:    make(map[string]time.Time),
+		counters: make(map[memCounterKey]int64),
+	}
+}
+
+// Close implements Backend.Close.
+func (b *memBackend) Close() {}
+
+// InsertCharm implements Backend.InsertCharm.
+func (b *memBackend) InsertCharm(doc *CharmDoc, lockToken string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lockToken != "" {
+		for _, url := range doc.URLs {
+			if lock, ok := b.locks[url.String()]; !ok || lock.Token != lockToken {
+				return ErrUpdateConflict
+			}
+		}
+	}
+	for _, old := range b.charms {
+		if old.Revision != doc.Revision {
+			continue
+		}
+		for _, url := range doc.URLs {
+			if old.hasURL(url) {
+				return ErrUpdateConflict
+			}
+		}
+	}
+	newDoc := *doc
+	b.charms = append(b.charms, &newDoc)
+	return nil
+}
+
+// FindCharms implements Backend.FindCharms.
+func (b *memBackend) FindCharms(url *charm.URL, n int, filter DeletedFilter) ([]*CharmDoc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rev := url.Revision
+	url = url.WithRevision(-1)
+	var docs []*CharmDoc
+	for _, doc := range b.charms {
+		if (rev == -1 || doc.Revision == rev) && doc.hasURL(url) && filter.matches(doc) {
+			newDoc := *doc
+			docs = append(docs, &newDoc)
+		}
+	}
+	sort.Sort(byRevisionDesc(docs))
+	if n > 0 && len(docs) > n {
+		docs = docs[:n]
+	}
+	return docs, nil
+}
+
+type byRevisionDesc []*CharmDoc
+
+func (s byRevisionDesc) Len() int           { return len(s) }
+func (s byRevisionDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRevisionDesc) Less(i, j int) bool { return s[i].Revision > s[j].Revision }
+
+// FindCharmsByReference implements Backend.FindCharmsByReference.
+func (b *memBackend) FindCharmsByReference(ref charm.Reference) ([]*CharmDoc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ref.Revision = -1
+	var docs []*CharmDoc
+	for _, doc := range b.charms {
+		if doc.Deleted != nil {
+			continue
+		}
+		for _, url := range doc.URLs {
+			if url.Reference == ref {
+				newDoc := *doc
+				docs = append(docs, &newDoc)
+				break
+			}
+		}
+	}
+	return docs, nil
+}
+
+// FindDeletedCharms implements Backend.FindDeletedCharms.
+func (b *memBackend) FindDeletedCharms(before time.Time) ([]*CharmDoc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var docs []*CharmDoc
+	for _, doc := range b.charms {
+		if doc.Deleted != nil && doc.Deleted.Time.Before(before) {
+			newDoc := *doc
+			docs = append(docs, &newDoc)
+		}
+	}
+	return docs, nil
+}
+
+// SetCharmDeletion implements Backend.SetCharmDeletion.
+func (b *memBackend) SetCharmDeletion(url *charm.URL, revision int, deletion *CharmDeletion) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, doc := range b.charms {
+		if doc.Revision == revision && doc.hasURL(url) {
+			if deletion != nil {
+				newDeletion := *deletion
+				deletion = &newDeletion
+			}
+			doc.Deleted = deletion
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RemoveCharm implements Backend.RemoveCharm.
+func (b *memBackend) RemoveCharm(url *charm.URL, revision int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, doc := range b.charms {
+		if doc.Revision == revision && doc.hasURL(url) {
+			b.charms = append(b.charms[:i], b.charms[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RefBlob implements Backend.RefBlob.
+func (b *memBackend) RefBlob(sha256 string) (BlobId, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ref, ok := b.blobRefs[sha256]
+	if !ok {
+		return "", ErrNotFound
+	}
+	ref.Refs++
+	return ref.BlobId, nil
+}
+
+// InsertBlobRef implements Backend.InsertBlobRef.
+func (b *memBackend) InsertBlobRef(sha256 string, id BlobId) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.blobRefs[sha256]; ok {
+		return ErrUpdateConflict
+	}
+	b.blobRefs[sha256] = &BlobRef{Sha256: sha256, BlobId: id, Refs: 1}
+	return nil
+}
+
+// UnrefBlob implements Backend.UnrefBlob.
+func (b *memBackend) UnrefBlob(sha256 string, id BlobId, token string) (removed bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ref, ok := b.blobRefs[sha256]
+	if !ok || ref.BlobId != id {
+		return false, ErrNotFound
+	}
+	if token != "" {
+		for _, t := range ref.Unrefs {
+			if t == token {
+				return false, nil
+			}
+		}
+		ref.Unrefs = append(ref.Unrefs, token)
+	}
+	ref.Refs--
+	if ref.Refs > 0 {
+		return false, nil
+	}
+	delete(b.blobRefs, sha256)
+	return true, nil
+}
+
+// BlobRefs implements Backend.BlobRefs.
+func (b *memBackend) BlobRefs() ([]*BlobRef, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var refs []*BlobRef
+	for _, ref := range b.blobRefs {
+		newRef := *ref
+		refs = append(refs, &newRef)
+	}
+	return refs, nil
+}
+
+// SetBlobRef implements Backend.SetBlobRef.
+func (b *memBackend) SetBlobRef(ref *BlobRef) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ref.Refs > 0 {
+		newRef := *ref
+		b.blobRefs[ref.Sha256] = &newRef
+	} else {
+		delete(b.blobRefs, ref.Sha256)
+	}
+	return nil
+}
+
+// IterCharms implements Backend.IterCharms.
+func (b *memBackend) IterCharms(f func(doc *CharmDoc) error) error {
+	b.mu.Lock()
+	docs := make([]*CharmDoc, len(b.charms))
+	for i, doc := range b.charms {
+		newDoc := *doc
+		docs[i] = &newDoc
+	}
+	b.mu.Unlock()
+	for _, doc := range docs {
+		if err := f(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertDeleteIntent implements Backend.InsertDeleteIntent.
+func (b *memBackend) InsertDeleteIntent(intent *DeleteIntent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	newIntent := *intent
+	b.intents = append(b.intents, &newIntent)
+	return nil
+}
+
+// DeleteIntents implements Backend.DeleteIntents.
+func (b *memBackend) DeleteIntents() ([]*DeleteIntent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	intents := make([]*DeleteIntent, len(b.intents))
+	for i, intent := range b.intents {
+		newIntent := *intent
+		intents[i] = &newIntent
+	}
+	return intents, nil
+}
+
+// RemoveDeleteIntent implements Backend.RemoveDeleteIntent.
+func (b *memBackend) RemoveDeleteIntent(intent *DeleteIntent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, other := range b.intents {
+		if other.Id == intent.Id {
+			b.intents = append(b.intents[:i], b.intents[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// InsertEvent implements Backend.InsertEvent.
+func (b *memBackend) InsertEvent(event *CharmEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	newEvent := *event
+	// MongoDB stores times in milliseconds.
+	newEvent.Time = time.Unix(0, event.Time.UnixNano()/1e6*1e6)
+	b.events = append(b.events, &newEvent)
+	return nil
+}
+
+// FindEvent implements Backend.FindEvent.
+func (b *memBackend) FindEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found *CharmEvent
+	for _, event := range b.events {
+		if digest != "" && event.Digest != digest {
+			continue
+		}
+		if found != nil && event.Time.Before(found.Time) {
+			continue
+		}
+		for _, u := range event.URLs {
+			if *u == *url {
+				found = event
+				break
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	event := *found
+	return &event, nil
+}
+
+// InsertLock implements Backend.InsertLock.
+func (b *memBackend) InsertLock(lock *LockDoc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.locks[lock.Key]; ok {
+		return ErrUpdateConflict
+	}
+	doc := *lock
+	b.locks[lock.Key] = &doc
+	return nil
+}
+
+// RemoveLock implements Backend.RemoveLock.
+func (b *memBackend) RemoveLock(key, token string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if doc, ok := b.locks[key]; ok && doc.Token == token {
+		delete(b.locks, key)
+	}
+	return nil
+}
+
+// RenewLock implements Backend.RenewLock.
+func (b *memBackend) RenewLock(key, token string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	doc, ok := b.locks[key]
+	if !ok || doc.Token != token {
+		return ErrUpdateConflict
+	}
+	doc.Time = t
+	return nil
+}
+
+// ExpireLock implements Backend.ExpireLock.
+func (b *memBackend) ExpireLock(key string, before time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if doc, ok := b.locks[key]; ok && doc.Time.Before(before) {
+		delete(b.locks, key)
+	}
+	return nil
+}
+
+// SyncTime implements Backend.SyncTime.
+func (b *memBackend) SyncTime(name string) (time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.syncs[name]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return t, nil
+}
+
+// SetSyncTime implements Backend.SetSyncTime.
+func (b *memBackend) SetSyncTime(name string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncs[name] = t
+	return nil
+}
+
+// InsertJob implements Backend.InsertJob.
+func (b *memBackend) InsertJob(job *PublishJob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	doc := *job
+	b.jobs = append(b.jobs, &doc)
+	return nil
+}
+
+// ClaimJob implements Backend.ClaimJob.
+func (b *memBackend) ClaimJob(owner string, now, lease time.Time) (*PublishJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Jobs are kept in creation order.
+	for _, doc := range b.jobs {
+		if doc.State == JobPending || doc.State == JobRunning && doc.Lease.Before(now) {
+			doc.State = JobRunning
+			doc.Owner = owner
+			doc.Lease = lease
+			doc.Updated = now
+			doc.Progress = ""
+			job := *doc
+			return &job, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// UpdateJob implements Backend.UpdateJob.
+func (b *memBackend) UpdateJob(job *PublishJob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, doc := range b.jobs {
+		if doc.Id != job.Id {
+			continue
+		}
+		if doc.State != JobRunning || doc.Owner != job.Owner {
+			break
+		}
+		doc.State = job.State
+		doc.Lease = job.Lease
+		doc.Progress = job.Progress
+		doc.Revision = job.Revision
+		doc.Redundant = job.Redundant
+		doc.Error = job.Error
+		doc.Transient = job.Transient
+		doc.Invalid = job.Invalid
+		doc.Updated = job.Updated
+		return nil
+	}
+	return ErrUpdateConflict
+}
+
+// FindJob implements Backend.FindJob.
+func (b *memBackend) FindJob(id string) (*PublishJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, doc := range b.jobs {
+		if doc.Id == id {
+			job := *doc
+			return &job, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// FindJobs implements Backend.FindJobs.
+func (b *memBackend) FindJobs(states ...JobState) ([]*PublishJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var jobs []*PublishJob
+	for _, doc := range b.jobs {
+		for _, state := range states {
+			if doc.State == state {
+				job := *doc
+				jobs = append(jobs, &job)
+				break
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// JobCounts implements Backend.JobCounts.
+func (b *memBackend) JobCounts() (map[JobState]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := make(map[JobState]int)
+	for _, state := range JobStates {
+		counts[state] = 0
+	}
+	for _, doc := range b.jobs {
+		counts[doc.State]++
+	}
+	return counts, nil
+}
+
+// BreakLock implements Backend.BreakLock.
+func (b *memBackend) BreakLock(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.locks[key]; !ok {
+		return ErrNotFound
+	}
+	delete(b.locks, key)
+	return nil
+}
+
+// Locks implements Backend.Locks.
+func (b *memBackend) Locks() ([]*LockDoc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.locks))
+	for key := range b.locks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	locks := make([]*LockDoc, len(keys))
+	for i, key := range keys {
+		lock := *b.locks[key]
+		locks[i] = &lock
+	}
+	return locks, nil
+}
+
+// CreateBlob implements BlobStore.CreateBlob.
+func (b *memBackend) CreateBlob() (BlobWriter, error) {
+	return &memBlobWriter{backend: b}, nil
+}
+
+// OpenBlob implements BlobStore.OpenBlob.
+func (b *memBackend) OpenBlob(id BlobId) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.blobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return memBlob{bytes.NewReader(data)}, nil
+}
+
+// memBlob is a blob opened for reading from a memBackend.
+type memBlob struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (memBlob) Close() error {
+	return nil
+}
+
+// RemoveBlob implements BlobStore.RemoveBlob.
+func (b *memBackend) RemoveBlob(id BlobId) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.blobs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(b.blobs, id)
+	return nil
+}
+
+// BlobIds implements BlobStore.BlobIds.
+func (b *memBackend) BlobIds() ([]BlobId, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []BlobId
+	for id := range b.blobs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// memBlobWriter is a BlobWriter that buffers the blob data until
+// it's finished.
+type memBlobWriter struct {
+	backend *memBackend
+	buf     bytes.Buffer
+}
+
+func (w *memBlobWriter) Write(data []byte) (n int, err error) {
+	return w.buf.Write(data)
+}
+
+func (w *memBlobWriter) Finish(sha256 string) (BlobId, error) {
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastBlob++
+	id := BlobId(strconv.Itoa(b.lastBlob))
+	b.blobs[id] = w.buf.Bytes()
+	return id, nil
+}
+
+func (w *memBlobWriter) Abort() {}
+
+// IncCounter implements Backend.IncCounter.
+func (b *memBackend) IncCounter(key []string, t time.Time) error {
+	return b.IncCounters([]CounterInc{{key, t, 1}})
+}
+
+// IncCounters implements Backend.IncCounters.
+func (b *memBackend) IncCounters(incs []CounterInc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, inc := range incs {
+		b.counters[memCounterKey{strings.Join(inc.Key, memKeySep), timeToStamp(inc.Time)}] += inc.Count
+	}
+	return nil
+}
+
+// Counters implements Backend.Counters.
+func (b *memBackend) Counters(req *CounterRequest) ([]Counter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type aggKey struct {
+		key    string
+		prefix bool
+		period int64
+	}
+	sums := make(map[aggKey]int64)
+	for ck, count := range b.counters {
+		if !req.Start.IsZero() && ck.stamp < timeToStamp(req.Start) {
+			continue
+		}
+		if !req.Stop.IsZero() && ck.stamp > timeToStamp(req.Stop) {
+			continue
+		}
+		key := strings.Split(ck.key, memKeySep)
+		if !counterKeyMatches(req, key) {
+			continue
+		}
+		// The aggregation mirrors the one done in MongoDB. See
+		// mongoBackend.Counters for details.
+		var k aggKey
+		if req.List && req.Prefix {
+			n := len(req.Key) + 1
+			k.key = strings.Join(key[:n], memKeySep)
+			k.prefix = len(key) > n
+		} else {
+			k.key = strings.Join(req.Key, memKeySep)
+			k.prefix = req.Prefix
+		}
+		switch req.By {
+		case ByDay:
+			k.period = int64(ck.stamp) / 86400
+		case ByWeek:
+			k.period = int64(ck.stamp) / 604800
+		}
+		sums[k] += count
+	}
+	var counters []Counter
+	for k, sum := range sums {
+		counter := Counter{
+			Key:    strings.Split(k.key, memKeySep),
+			Prefix: k.prefix,
+			Count:  sum,
+		}
+		if req.By != ByAll {
+			counter.Time = stampPeriodTime(req.By, k.period)
+		}
+		counters = append(counters, counter)
+	}
+	return counters, nil
+}
+
+// counterKeyMatches returns whether the counter with the given key
+// is selected by req.
+func counterKeyMatches(req *CounterRequest, key []string) bool {
+	if len(key) < len(req.Key) || req.Prefix && len(key) == len(req.Key) {
+		return false
+	}
+	if !req.Prefix && len(key) != len(req.Key) {
+		return false
+	}
+	for i := range req.Key {
+		if key[i] != req.Key[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"time"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/store"
+)
+
+var _ = gc.Suite(&MemStoreSuite{})
+
+// MemStoreSuite runs the StoreSuite tests against a store created
+// with NewMemStore. It doesn't need MongoDB.
+type MemStoreSuite struct {
+	StoreSuite
+}
+
+func (s *MemStoreSuite) SetUpSuite(c *gc.C) {
+	s.BaseSuite.SetUpSuite(c)
+	s.HTTPSuite.SetUpSuite(c)
+}
+
+func (s *MemStoreSuite) TearDownSuite(c *gc.C) {
+	s.HTTPSuite.TearDownSuite(c)
+	s.BaseSuite.TearDownSuite(c)
+}
+
+func (s *MemStoreSuite) SetUpTest(c *gc.C) {
+	s.BaseSuite.SetUpTest(c)
+	s.HTTPSuite.SetUpTest(c)
+	s.PatchValue(&store.PublishRetryStrategy, fastRetryStrategy)
+	var err error
+	s.store, err = store.NewMemStore()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *MemStoreSuite) TearDownTest(c *gc.C) {
+	if s.store != nil {
+		s.store.Close()
+	}
+	s.HTTPSuite.TearDownTest(c)
+	s.BaseSuite.TearDownTest(c)
+}
+
+func (s *MemStoreSuite) TestMemCounters(c *gc.C) {
+	incs := [][]string{
+		{"a"},
+		{"a", "b"},
+		{"a", "b", "c"},
+		{"a", "b", "c"},
+		{"a", "b", "d"},
+		{"a", "f", "g"},
+		{"a", "i"},
+		{"k", "l"},
+	}
+	for _, key := range incs {
+		err := s.store.IncCounter(key)
+		c.Assert(err, gc.IsNil)
+	}
+
+	tests := []struct {
+		req    store.CounterRequest
+		result []store.Counter
+	}{{
+		store.CounterRequest{Key: []string{"a"}},
+		[]store.Counter{{Key: []string{"a"}, Count: 1}},
+	}, {
+		store.CounterRequest{Key: []string{"a"}, Prefix: true},
+		[]store.Counter{{Key: []string{"a"}, Prefix: true, Count: 6}},
+	}, {
+		store.CounterRequest{Key: []string{"z"}},
+		[]store.Counter{{Key: []string{"z"}, Count: 0}},
+	}, {
+		store.CounterRequest{Key: []string{"a"}, Prefix: true, List: true},
+		[]store.Counter{
+			{Key: []string{"a", "b"}, Prefix: true, Count: 3},
+			{Key: []string{"a", "b"}, Prefix: false, Count: 1},
+			{Key: []string{"a", "f"}, Prefix: true, Count: 1},
+			{Key: []string{"a", "i"}, Prefix: false, Count: 1},
+		},
+	}, {
+		store.CounterRequest{Key: []string{"z"}, Prefix: true, List: true},
+		[]store.Counter(nil),
+	}}
+	day := func(i int) time.Time {
+		return time.Date(2012, time.May, i, 0, 0, 0, 0, time.UTC)
+	}
+	backend := store.StoreBackend(s.store)
+	dated := []struct {
+		key []string
+		day int
+	}{
+		{[]string{"x"}, 1},
+		{[]string{"x"}, 1},
+		{[]string{"x", "y"}, 2},
+		{[]string{"x", "z", "w"}, 9},
+	}
+	for i, inc := range dated {
+		err := backend.IncCounter(inc.key, day(inc.day).Add(time.Duration(i)*time.Minute))
+		c.Assert(err, gc.IsNil)
+	}
+	tests = append(tests, []struct {
+		req    store.CounterRequest
+		result []store.Counter
+	}{{
+		store.CounterRequest{Key: []string{"x"}, By: store.ByDay},
+		[]store.Counter{{Key: []string{"x"}, Count: 2, Time: day(1)}},
+	}, {
+		store.CounterRequest{Key: []string{"x"}, Prefix: true, By: store.ByDay},
+		[]store.Counter{
+			{Key: []string{"x"}, Prefix: true, Count: 1, Time: day(2)},
+			{Key: []string{"x"}, Prefix: true, Count: 1, Time: day(9)},
+		},
+	}, {
+		store.CounterRequest{Key: []string{"x"}, Prefix: true, By: store.ByWeek},
+		[]store.Counter{
+			{Key: []string{"x"}, Prefix: true, Count: 1, Time: day(6)},
+			{Key: []string{"x"}, Prefix: true, Count: 1, Time: day(13)},
+		},
+	}, {
+		store.CounterRequest{Key: []string{"x"}, Prefix: true, List: true, By: store.ByDay},
+		[]store.Counter{
+			{Key: []string{"x", "y"}, Count: 1, Time: day(2)},
+			{Key: []string{"x", "z"}, Prefix: true, Count: 1, Time: day(9)},
+		},
+	}, {
+		store.CounterRequest{Key: []string{"x"}, Prefix: true, List: true, By: store.ByWeek, Stop: day(5)},
+		[]store.Counter{
+			{Key: []string{"x", "y"}, Count: 1, Time: day(6)},
+		},
+	}}...)
+	for _, t := range tests {
+		result, err := s.store.Counters(&t.req)
+		c.Assert(err, gc.IsNil)
+		c.Assert(result, gc.DeepEquals, t.result)
+	}
+}
@@ -0,0 +1,1133 @@
+// Copyright 2011, 2012, 2013, 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// The following MongoDB collections are currently used:
+//
+//     juju.events        - Log of events relating to the lifecycle of charms
+//     juju.charms        - Information about the stored charms
+//     juju.charmfs.*     - GridFS with the charm files
+//     juju.blobs         - Reference counts of charm files, by content hash
+//     juju.deletes       - Pending deletions of charm revisions
+//     juju.locks         - Has unique keys with url of updating charms
+//     juju.jobs          - Queue of charm publishing jobs
+//     juju.syncs         - Times of the last syncs with external sources
+//     juju.stat.counters - Counters for statistics
+//     juju.stat.tokens   - Tokens used in statistics counter keys
+
+// mongoBackend is a Backend that keeps all the store data in MongoDB.
+type mongoBackend struct {
+	session *storeSession
+
+	// Cache for statistics key words (two generations).
+	cacheMu       sync.RWMutex
+	statsIdNew    map[string]int
+	statsIdOld    map[string]int
+	statsTokenNew map[int]string
+	statsTokenOld map[int]string
+}
+
+// Statically ensure that *mongoBackend is indeed a Backend.
+var _ Backend = (*mongoBackend)(nil)
+
+// NewMongoBackend returns a Backend that connects to the MongoDB
+// server at the given address (as expected by the Mongo function in
+// the labix.org/v2/mgo package).
+func NewMongoBackend(mongoAddr string) (Backend, error) {
+	session, err := mgo.Dial(mongoAddr)
+	if err != nil {
+		logger.Errorf("error connecting to MongoDB: %v", err)
+		return nil, err
+	}
+
+	b := &mongoBackend{session: &storeSession{session}}
+
+	// Ignore error. It'll always fail after created.
+	// TODO Check the error once mgo hands it to us.
+	_ = b.session.DB("juju").Run(bson.D{{"create", "stat.counters"}, {"autoIndexId", false}}, nil)
+
+	if err := b.ensureIndexes(); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	// Put the used socket back in the pool.
+	session.Refresh()
+	return b, nil
+}
+
+func (b *mongoBackend) ensureIndexes() error {
+	session := b.session
+	indexes := []struct {
+		c *mgo.Collection
+		i mgo.Index
+	}{{
+		session.StatCounters(),
+		mgo.Index{Key: []string{"k", "t"}, Unique: true},
+	}, {
+		session.StatTokens(),
+		mgo.Index{Key: []string{"t"}, Unique: true},
+	}, {
+		session.Charms(),
+		mgo.Index{Key: []string{"urls", "revision"}, Unique: true},
+	}, {
+		session.Events(),
+		mgo.Index{Key: []string{"urls", "digest"}},
+	}, {
+		session.Jobs(),
+		mgo.Index{Key: []string{"state", "created"}},
+	}}
+	for _, idx := range indexes {
+		err := idx.c.EnsureIndex(idx.i)
+		if err != nil {
+			logger.Errorf("error ensuring stat.counters index: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Close terminates the connection with MongoDB.
+func (b *mongoBackend) Close() {
+	b.session.Close()
+}
+
+// pendingCharmDoc is a charm document inserted by the holder of the
+// update locks with LockToken. Such documents reserve their revision,
+// but are hidden until the locks are confirmed to be held, when the
+// token is removed.
+type pendingCharmDoc struct {
+	CharmDoc  `bson:",inline"`
+	LockToken string
+}
+
+// notPending selects the charm documents that aren't pending.
+var notPending = bson.DocElem{"locktoken", bson.D{{"$exists", false}}}
+
+// InsertCharm implements Backend.InsertCharm. When locks are involved,
+// the document is inserted as pending, the locks are checked, and the
+// document is then either revealed or removed. A stale lock holder
+// may find the locks still held and reveal the document after losing
+// them only if the new holder hasn't inserted a charm at the same
+// revision meanwhile, which removes the pending document first.
+func (b *mongoBackend) InsertCharm(doc *CharmDoc, lockToken string) error {
+	session := b.session.Copy()
+	defer session.Close()
+	if lockToken == "" {
+		return maybeConflict(session.Charms().Insert(doc))
+	}
+	err := maybeConflict(session.Charms().Insert(&pendingCharmDoc{*doc, lockToken}))
+	if err == ErrUpdateConflict {
+		// The revision may be reserved by the pending document of a
+		// stale lock holder.
+		var removed bool
+		removed, err = session.removeStaleCharms(doc)
+		if removed {
+			err = maybeConflict(session.Charms().Insert(&pendingCharmDoc{*doc, lockToken}))
+		} else if err == nil {
+			err = ErrUpdateConflict
+		}
+	}
+	if err != nil {
+		return err
+	}
+	pending := bson.D{{"revision", doc.Revision}, {"locktoken", lockToken}}
+	held, err := session.locksHeld(doc.URLs, lockToken)
+	if err == nil && held {
+		err = session.Charms().Update(pending, bson.D{{"$unset", bson.D{{"locktoken", 1}}}})
+		if err == mgo.ErrNotFound {
+			// The locks were lost meanwhile, and the document was
+			// removed by the new holder.
+			return ErrUpdateConflict
+		}
+		return err
+	}
+	if rerr := session.Charms().Remove(pending); rerr != nil && rerr != mgo.ErrNotFound {
+		logger.Errorf("cannot remove pending charm %v revision %d: %v", doc.URLs, doc.Revision, rerr)
+	}
+	if err != nil {
+		return err
+	}
+	return ErrUpdateConflict
+}
+
+// FindCharms implements Backend.FindCharms.
+func (b *mongoBackend) FindCharms(url *charm.URL, n int, filter DeletedFilter) ([]*CharmDoc, error) {
+	session := b.session.Copy()
+	defer session.Close()
+
+	rev := url.Revision
+	url = url.WithRevision(-1)
+
+	qdoc := bson.D{{"urls", url}, notPending}
+	if rev != -1 {
+		qdoc = append(qdoc, bson.DocElem{"revision", rev})
+	}
+	switch filter {
+	case ExcludeDeleted:
+		qdoc = append(qdoc, bson.DocElem{"deleted", bson.D{{"$exists", false}}})
+	case OnlyDeleted:
+		qdoc = append(qdoc, bson.DocElem{"deleted", bson.D{{"$exists", true}}})
+	}
+	q := session.Charms().Find(qdoc).Sort("-revision")
+	if n > 0 {
+		q = q.Limit(n)
+	}
+	var docs []*CharmDoc
+	if err := q.All(&docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// FindCharmsByReference implements Backend.FindCharmsByReference.
+func (b *mongoBackend) FindCharmsByReference(ref charm.Reference) ([]*CharmDoc, error) {
+	session := b.session.Copy()
+	defer session.Close()
+
+	patternURL := &charm.URL{Reference: ref, Series: "[a-z][^/]+"}
+	patternURL = patternURL.WithRevision(-1)
+
+	q := session.Charms().Find(bson.M{
+		"urls":      bson.RegEx{Pattern: fmt.Sprintf("^%s$", patternURL.String())},
+		"deleted":   bson.M{"$exists": false},
+		"locktoken": bson.M{"$exists": false},
+	})
+	var docs []*CharmDoc
+	if err := q.All(&docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// FindDeletedCharms implements Backend.FindDeletedCharms.
+func (b *mongoBackend) FindDeletedCharms(before time.Time) ([]*CharmDoc, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var docs []*CharmDoc
+	err := session.Charms().Find(bson.D{{"deleted.time", bson.D{{"$lt", before}}}}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// SetCharmDeletion implements Backend.SetCharmDeletion.
+func (b *mongoBackend) SetCharmDeletion(url *charm.URL, revision int, deletion *CharmDeletion) error {
+	session := b.session.Copy()
+	defer session.Close()
+	var update bson.D
+	if deletion != nil {
+		update = bson.D{{"$set", bson.D{{"deleted", deletion}}}}
+	} else {
+		update = bson.D{{"$unset", bson.D{{"deleted", 1}}}}
+	}
+	err := session.Charms().Update(bson.D{{"urls", url}, {"revision", revision}}, update)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// RemoveCharm implements Backend.RemoveCharm.
+func (b *mongoBackend) RemoveCharm(url *charm.URL, revision int) error {
+	session := b.session.Copy()
+	defer session.Close()
+	err := session.Charms().Remove(bson.D{{"urls", url}, {"revision", revision}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// RefBlob implements Backend.RefBlob.
+func (b *mongoBackend) RefBlob(sha256 string) (BlobId, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var doc BlobRef
+	change := mgo.Change{Update: bson.D{{"$inc", bson.D{{"refs", 1}}}}, ReturnNew: true}
+	_, err := session.BlobRefs().FindId(sha256).Apply(change, &doc)
+	if err == mgo.ErrNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.BlobId, nil
+}
+
+// InsertBlobRef implements Backend.InsertBlobRef.
+func (b *mongoBackend) InsertBlobRef(sha256 string, id BlobId) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return maybeConflict(session.BlobRefs().Insert(&BlobRef{Sha256: sha256, BlobId: id, Refs: 1}))
+}
+
+// UnrefBlob implements Backend.UnrefBlob.
+func (b *mongoBackend) UnrefBlob(sha256 string, id BlobId, token string) (removed bool, err error) {
+	session := b.session.Copy()
+	defer session.Close()
+	blobs := session.BlobRefs()
+	query := bson.D{{"_id", sha256}, {"blobid", id}}
+	update := bson.D{{"$inc", bson.D{{"refs", -1}}}}
+	if token != "" {
+		query = append(query, bson.DocElem{"unrefs", bson.D{{"$ne", token}}})
+		update = append(update, bson.DocElem{"$push", bson.D{{"unrefs", token}}})
+	}
+	var doc BlobRef
+	change := mgo.Change{Update: update, ReturnNew: true}
+	_, err = blobs.Find(query).Apply(change, &doc)
+	if err == mgo.ErrNotFound && token != "" {
+		// The reference may have been dropped with the same token.
+		err = blobs.Find(bson.D{{"_id", sha256}, {"blobid", id}}).One(&doc)
+		if err == nil {
+			return false, nil
+		}
+	}
+	if err == mgo.ErrNotFound {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if doc.Refs > 0 {
+		return false, nil
+	}
+	// The reference count is checked again in case the blob was
+	// referenced concurrently.
+	err = blobs.Remove(bson.D{{"_id", sha256}, {"blobid", id}, {"refs", bson.D{{"$lte", 0}}}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// BlobRefs implements Backend.BlobRefs.
+func (b *mongoBackend) BlobRefs() ([]*BlobRef, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var refs []*BlobRef
+	if err := session.BlobRefs().Find(nil).All(&refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// SetBlobRef implements Backend.SetBlobRef.
+func (b *mongoBackend) SetBlobRef(ref *BlobRef) error {
+	session := b.session.Copy()
+	defer session.Close()
+	if ref.Refs > 0 {
+		_, err := session.BlobRefs().UpsertId(ref.Sha256, ref)
+		return err
+	}
+	err := session.BlobRefs().RemoveId(ref.Sha256)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// IterCharms implements Backend.IterCharms.
+func (b *mongoBackend) IterCharms(f func(doc *CharmDoc) error) error {
+	session := b.session.Copy()
+	defer session.Close()
+	iter := session.Charms().Find(nil).Iter()
+	for {
+		doc := &CharmDoc{}
+		if !iter.Next(doc) {
+			break
+		}
+		if err := f(doc); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// InsertDeleteIntent implements Backend.InsertDeleteIntent.
+func (b *mongoBackend) InsertDeleteIntent(intent *DeleteIntent) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return session.DeleteIntents().Insert(intent)
+}
+
+// DeleteIntents implements Backend.DeleteIntents.
+func (b *mongoBackend) DeleteIntents() ([]*DeleteIntent, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var intents []*DeleteIntent
+	if err := session.DeleteIntents().Find(nil).Sort("time").All(&intents); err != nil {
+		return nil, err
+	}
+	return intents, nil
+}
+
+// RemoveDeleteIntent implements Backend.RemoveDeleteIntent.
+func (b *mongoBackend) RemoveDeleteIntent(intent *DeleteIntent) error {
+	session := b.session.Copy()
+	defer session.Close()
+	err := session.DeleteIntents().RemoveId(intent.Id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// InsertEvent implements Backend.InsertEvent.
+func (b *mongoBackend) InsertEvent(event *CharmEvent) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return session.Events().Insert(event)
+}
+
+// FindEvent implements Backend.FindEvent.
+func (b *mongoBackend) FindEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	session := b.session.Copy()
+	defer session.Close()
+
+	events := session.Events()
+	event := &CharmEvent{Digest: digest}
+	var query *mgo.Query
+	if digest == "" {
+		query = events.Find(bson.D{{"urls", url}})
+	} else {
+		query = events.Find(bson.D{{"urls", url}, {"digest", digest}})
+	}
+	err := query.Sort("-time").One(&event)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// InsertLock implements Backend.InsertLock.
+func (b *mongoBackend) InsertLock(lock *LockDoc) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return maybeConflict(session.Locks().Insert(lock))
+}
+
+// RemoveLock implements Backend.RemoveLock.
+func (b *mongoBackend) RemoveLock(key, token string) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return session.Locks().Remove(bson.D{{"_id", key}, {"token", token}})
+}
+
+// RenewLock implements Backend.RenewLock.
+func (b *mongoBackend) RenewLock(key, token string, t time.Time) error {
+	session := b.session.Copy()
+	defer session.Close()
+	err := session.Locks().Update(bson.D{{"_id", key}, {"token", token}}, bson.D{{"$set", bson.D{{"time", t}}}})
+	if err == mgo.ErrNotFound {
+		return ErrUpdateConflict
+	}
+	return err
+}
+
+// ExpireLock implements Backend.ExpireLock.
+func (b *mongoBackend) ExpireLock(key string, before time.Time) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return session.Locks().Remove(bson.D{{"_id", key}, {"time", bson.D{{"$lt", before}}}})
+}
+
+// SyncTime implements Backend.SyncTime.
+func (b *mongoBackend) SyncTime(name string) (time.Time, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var doc struct{ Time time.Time }
+	err := session.Syncs().FindId(name).One(&doc)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return doc.Time, nil
+}
+
+// SetSyncTime implements Backend.SetSyncTime.
+func (b *mongoBackend) SetSyncTime(name string, t time.Time) error {
+	session := b.session.Copy()
+	defer session.Close()
+	_, err := session.Syncs().UpsertId(name, bson.D{{"_id", name}, {"time", t}})
+	return err
+}
+
+// InsertJob implements Backend.InsertJob.
+func (b *mongoBackend) InsertJob(job *PublishJob) error {
+	session := b.session.Copy()
+	defer session.Close()
+	return session.Jobs().Insert(job)
+}
+
+// ClaimJob implements Backend.ClaimJob.
+func (b *mongoBackend) ClaimJob(owner string, now, lease time.Time) (*PublishJob, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	query := bson.D{{"$or", []bson.D{
+		{{"state", JobPending}},
+		{{"state", JobRunning}, {"lease", bson.D{{"$lt", now}}}},
+	}}}
+	update := bson.D{{"$set", bson.D{
+		{"state", JobRunning},
+		{"owner", owner},
+		{"lease", lease},
+		{"updated", now},
+	}}, {"$unset", bson.D{{"progress", 1}}}}
+	var job PublishJob
+	change := mgo.Change{Update: update, ReturnNew: true}
+	_, err := session.Jobs().Find(query).Sort("created").Apply(change, &job)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJob implements Backend.UpdateJob.
+func (b *mongoBackend) UpdateJob(job *PublishJob) error {
+	session := b.session.Copy()
+	defer session.Close()
+	query := bson.D{{"_id", job.Id}, {"state", JobRunning}, {"owner", job.Owner}}
+	update := bson.D{{"$set", bson.D{
+		{"state", job.State},
+		{"lease", job.Lease},
+		{"progress", job.Progress},
+		{"revision", job.Revision},
+		{"redundant", job.Redundant},
+		{"error", job.Error},
+		{"transient", job.Transient},
+		{"invalid", job.Invalid},
+		{"updated", job.Updated},
+	}}}
+	err := session.Jobs().Update(query, update)
+	if err == mgo.ErrNotFound {
+		return ErrUpdateConflict
+	}
+	return err
+}
+
+// FindJob implements Backend.FindJob.
+func (b *mongoBackend) FindJob(id string) (*PublishJob, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var job PublishJob
+	err := session.Jobs().FindId(id).One(&job)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FindJobs implements Backend.FindJobs.
+func (b *mongoBackend) FindJobs(states ...JobState) ([]*PublishJob, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var jobs []*PublishJob
+	query := bson.D{{"state", bson.D{{"$in", states}}}}
+	if err := session.Jobs().Find(query).Sort("created").All(&jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// JobCounts implements Backend.JobCounts.
+func (b *mongoBackend) JobCounts() (map[JobState]int, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	counts := make(map[JobState]int)
+	for _, state := range JobStates {
+		n, err := session.Jobs().Find(bson.D{{"state", state}}).Count()
+		if err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, nil
+}
+
+// BreakLock implements Backend.BreakLock.
+func (b *mongoBackend) BreakLock(key string) error {
+	session := b.session.Copy()
+	defer session.Close()
+	err := session.Locks().RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Locks implements Backend.Locks.
+func (b *mongoBackend) Locks() ([]*LockDoc, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var locks []*LockDoc
+	if err := session.Locks().Find(nil).Sort("_id").All(&locks); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// CreateBlob implements BlobStore.CreateBlob.
+func (b *mongoBackend) CreateBlob() (BlobWriter, error) {
+	session := b.session.Copy()
+	file, err := session.CharmFS().Create("")
+	if err != nil {
+		session.Close()
+		logger.Errorf("failed to create GridFS file: %v", err)
+		return nil, err
+	}
+	logger.Infof("creating GridFS file with id %q...", file.Id().(bson.ObjectId).Hex())
+	return &gridWriter{session, file}, nil
+}
+
+// OpenBlob implements BlobStore.OpenBlob.
+func (b *mongoBackend) OpenBlob(id BlobId) (io.ReadCloser, error) {
+	if !bson.IsObjectIdHex(string(id)) {
+		return nil, ErrNotFound
+	}
+	session := b.session.Copy()
+	file, err := session.CharmFS().OpenId(bson.ObjectIdHex(string(id)))
+	if err != nil {
+		session.Close()
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &gridReader{session, file}, nil
+}
+
+// RemoveBlob implements BlobStore.RemoveBlob.
+func (b *mongoBackend) RemoveBlob(id BlobId) error {
+	if !bson.IsObjectIdHex(string(id)) {
+		return ErrNotFound
+	}
+	session := b.session.Copy()
+	defer session.Close()
+	return session.CharmFS().RemoveId(bson.ObjectIdHex(string(id)))
+}
+
+// BlobIds implements BlobStore.BlobIds.
+func (b *mongoBackend) BlobIds() ([]BlobId, error) {
+	session := b.session.Copy()
+	defer session.Close()
+	var ids []BlobId
+	var file struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	iter := session.CharmFS().Files.Find(nil).Select(bson.D{{"_id", 1}}).Iter()
+	for iter.Next(&file) {
+		ids = append(ids, BlobId(file.Id.Hex()))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// gridWriter is a BlobWriter that writes into a GridFS file.
+type gridWriter struct {
+	session *storeSession
+	file    *mgo.GridFile
+}
+
+func (w *gridWriter) Write(data []byte) (n int, err error) {
+	return w.file.Write(data)
+}
+
+func (w *gridWriter) Finish(sha256 string) (BlobId, error) {
+	defer w.session.Close()
+	id := w.file.Id().(bson.ObjectId)
+	if err := w.file.Close(); err != nil {
+		logger.Errorf("failed to close GridFS file: %v", err)
+		return "", err
+	}
+	return BlobId(id.Hex()), nil
+}
+
+func (w *gridWriter) Abort() {
+	w.file.Abort()
+	// Ignore error. Already aborting due to a preceding bad situation
+	// elsewhere. This error is not important right now.
+	_ = w.file.Close()
+	w.session.Close()
+}
+
+// gridReader reads a GridFS file opened with its own session.
+type gridReader struct {
+	session *storeSession
+	file    *mgo.GridFile
+}
+
+// Read consumes data from the opened file.
+func (r *gridReader) Read(buf []byte) (n int, err error) {
+	return r.file.Read(buf)
+}
+
+// Seek sets the offset for the next Read on the opened file.
+func (r *gridReader) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
+
+// Close closes the opened file and frees associated resources.
+func (r *gridReader) Close() error {
+	err := r.file.Close()
+	r.session.Close()
+	return err
+}
+
+// IncCounter implements Backend.IncCounter.
+func (b *mongoBackend) IncCounter(key []string, t time.Time) error {
+	return b.IncCounters([]CounterInc{{key, t, 1}})
+}
+
+// IncCounters implements Backend.IncCounters. All the increments are
+// made with a single session.
+func (b *mongoBackend) IncCounters(incs []CounterInc) error {
+	session := b.session.Copy()
+	defer session.Close()
+
+	counters := session.StatCounters()
+	for _, inc := range incs {
+		skey, err := b.statsKey(session, inc.Key, true)
+		if err != nil {
+			return err
+		}
+		_, err = counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(inc.Time)}}, bson.D{{"$inc", bson.D{{"c", inc.Count}}}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counters implements Backend.Counters.
+func (b *mongoBackend) Counters(req *CounterRequest) ([]Counter, error) {
+	session := b.session.Copy()
+	defer session.Close()
+
+	searchKey, err := b.statsKey(session, req.Key, false)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The counters are summed per period, and per key when listing.
+	// Listed keys are first cut after the token that follows the
+	// search key, so that they're summed under that prefix.
+	var id bson.D
+	if req.List && req.Prefix {
+		id = append(id, bson.DocElem{"k", "$k"})
+	}
+	switch req.By {
+	case ByDay:
+		id = append(id, bson.DocElem{"p", periodExpr(86400)})
+	case ByWeek:
+		id = append(id, bson.DocElem{"p", periodExpr(604800)})
+	}
+	var groupId interface{}
+	if len(id) > 0 {
+		groupId = id
+	}
+	pipeline := []bson.D{{{"$match", countersQuery(req, searchKey)}}}
+	if req.List && req.Prefix {
+		pipeline = append(pipeline, listKeyStages(len(searchKey))...)
+	}
+	pipeline = append(pipeline, bson.D{{"$group", bson.D{{"_id", groupId}, {"c", bson.D{{"$sum", "$c"}}}}}})
+	var result []struct {
+		Id struct {
+			Key    string  `bson:"k"`
+			Period float64 `bson:"p"`
+		} `bson:"_id"`
+		Count int64 `bson:"c"`
+	}
+	err = session.StatCounters().Pipe(pipeline).All(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	var counters []Counter
+	for _, r := range result {
+		key := searchKey
+		if req.List && req.Prefix {
+			key = r.Id.Key
+		} else if req.Prefix {
+			// For a search key "a:b:" matching any longer key, the key is "a:b:*".
+			key += "*"
+		}
+		tokens, err := b.statsKeyTokens(session, key)
+		if err != nil {
+			return nil, err
+		}
+		counter := Counter{
+			Key:    tokens,
+			Prefix: strings.HasSuffix(key, "*"),
+			Count:  r.Count,
+		}
+		if req.By != ByAll {
+			counter.Time = stampPeriodTime(req.By, int64(r.Id.Period))
+		}
+		counters = append(counters, counter)
+	}
+	return counters, nil
+}
+
+// countersQuery returns the query for the counters matched by req,
+// given the statistics identifier for req.Key.
+func countersQuery(req *CounterRequest, searchKey string) bson.D {
+	var regex string
+	if req.Prefix {
+		regex = "^" + searchKey + ".+"
+	} else {
+		regex = "^" + searchKey + "$"
+	}
+	query := bson.D{{"k", bson.D{{"$regex", regex}}}}
+	var tquery bson.D
+	if !req.Start.IsZero() {
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$gte",
+			Value: timeToStamp(req.Start),
+		})
+	}
+	if !req.Stop.IsZero() {
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$lte",
+			Value: timeToStamp(req.Stop),
+		})
+	}
+	if len(tquery) > 0 {
+		query = append(query, bson.DocElem{"t", tquery})
+	}
+	return query
+}
+
+// maxTokenIdDigits is the maximum length of a token id in a
+// statistics key, as formatted in base 32.
+const maxTokenIdDigits = 13
+
+// listKeyStages returns the aggregation pipeline stages that cut the
+// key of each counter after the token that follows the first n bytes
+// of it, appending "*" if anything was cut. For n matching the search
+// key "a:b:", the key "a:b:c:d:e:" becomes "a:b:c:*", and the key
+// "a:b:c:" is left alone.
+func listKeyStages(n int) []bson.D {
+	// The aggregation framework has no operator for finding a
+	// character in a string, but token ids are short, so the ":"
+	// ending the token is found by checking with $substr each of the
+	// positions it may be at.
+	var end interface{} = n + maxTokenIdDigits + 1
+	for i := maxTokenIdDigits; i > 0; i-- {
+		at := bson.D{{"$substr", []interface{}{"$k", n + i, 1}}}
+		end = bson.D{{"$cond", []interface{}{
+			bson.D{{"$eq", []interface{}{at, ":"}}},
+			n + i + 1,
+			end,
+		}}}
+	}
+	rest := bson.D{{"$substr", []interface{}{"$k", "$e", 1}}}
+	return []bson.D{
+		{{"$project", bson.D{{"k", 1}, {"t", 1}, {"c", 1}, {"e", end}}}},
+		{{"$project", bson.D{{"t", 1}, {"c", 1}, {"k", bson.D{{"$concat", []interface{}{
+			bson.D{{"$substr", []interface{}{"$k", 0, "$e"}}},
+			bson.D{{"$cond", []interface{}{bson.D{{"$eq", []interface{}{rest, ""}}}, "", "*"}}},
+		}}}}}}},
+	}
+}
+
+// periodExpr returns an aggregation expression for the number of the
+// period of the given length, in seconds, a counter falls in.
+func periodExpr(length int) bson.D {
+	return bson.D{{"$divide", []interface{}{
+		bson.D{{"$subtract", []interface{}{"$t", bson.D{{"$mod", []interface{}{"$t", length}}}}}},
+		length,
+	}}}
+}
+
+// statsKeyTokens returns the tokens represented by the statistics
+// identifier key, as returned by statsKey. A trailing "*" section is
+// ignored.
+func (b *mongoBackend) statsKeyTokens(session *storeSession, key string) ([]string, error) {
+	ids := strings.Split(key, ":")
+	tokens := make([]string, 0, len(ids))
+	for i := 0; i < len(ids)-1; i++ {
+		if ids[i] == "*" {
+			continue
+		}
+		id, err := strconv.ParseInt(ids[i], 32, 32)
+		if err != nil {
+			return nil, fmt.Errorf("store: invalid id: %q", ids[i])
+		}
+		token, found := b.statsIdToken(int(id))
+		if !found {
+			var t tokenId
+			err = session.StatTokens().FindId(id).One(&t)
+			if err == mgo.ErrNotFound {
+				return nil, fmt.Errorf("store: internal error; token id not found: %d", id)
+			}
+			b.cacheStatsTokenId(t.Token, t.Id)
+			token = t.Token
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// statsKey returns the compound statistics identifier that represents key.
+// If write is true, the identifier will be created if necessary.
+// Identifiers have a form similar to "ab:c:def:", where each section is a
+// base-32 number that represents the respective word in key. This form
+// allows efficiently indexing and searching for prefixes, while detaching
+// the key content and size from the actual words used in key.
+func (b *mongoBackend) statsKey(session *storeSession, key []string, write bool) (string, error) {
+	if len(key) == 0 {
+		return "", fmt.Errorf("store: empty statistics key")
+	}
+	tokens := session.StatTokens()
+	skey := make([]byte, 0, len(key)*4)
+	// Retry limit is mainly to prevent infinite recursion in edge cases,
+	// such as if the database is ever run in read-only mode.
+	// The logic below should deteministically stop in normal scenarios.
+	var err error
+	for i, retry := 0, 30; i < len(key) && retry > 0; retry-- {
+		err = nil
+		id, found := b.statsTokenId(key[i])
+		if !found {
+			var t tokenId
+			err = tokens.Find(bson.D{{"t", key[i]}}).One(&t)
+			if err == mgo.ErrNotFound {
+				if !write {
+					return "", ErrNotFound
+				}
+				t.Id, err = tokens.Count()
+				if err != nil {
+					continue
+				}
+				t.Id++
+				t.Token = key[i]
+				err = tokens.Insert(&t)
+			}
+			if err != nil {
+				continue
+			}
+			b.cacheStatsTokenId(t.Token, t.Id)
+			id = t.Id
+		}
+		skey = strconv.AppendInt(skey, int64(id), 32)
+		skey = append(skey, ':')
+		i++
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(skey), nil
+}
+
+const statsTokenCacheSize = 1024
+
+type tokenId struct {
+	Id    int    `bson:"_id"`
+	Token string `bson:"t"`
+}
+
+// cacheStatsTokenId adds the id for token into the cache.
+// The cache has two generations so that the least frequently used
+// tokens are evicted regularly.
+func (b *mongoBackend) cacheStatsTokenId(token string, id int) {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
+	// Can't possibly be >, but reviews want it for defensiveness.
+	if len(b.statsIdNew) >= statsTokenCacheSize {
+		b.statsIdOld = b.statsIdNew
+		b.statsIdNew = nil
+		b.statsTokenOld = b.statsTokenNew
+		b.statsTokenNew = nil
+	}
+	if b.statsIdNew == nil {
+		b.statsIdNew = make(map[string]int, statsTokenCacheSize)
+		b.statsTokenNew = make(map[int]string, statsTokenCacheSize)
+	}
+	b.statsIdNew[token] = id
+	b.statsTokenNew[id] = token
+}
+
+// statsTokenId returns the id for token from the cache, if found.
+func (b *mongoBackend) statsTokenId(token string) (id int, found bool) {
+	b.cacheMu.RLock()
+	id, found = b.statsIdNew[token]
+	if found {
+		b.cacheMu.RUnlock()
+		return
+	}
+	id, found = b.statsIdOld[token]
+	b.cacheMu.RUnlock()
+	if found {
+		b.cacheStatsTokenId(token, id)
+	}
+	return
+}
+
+// statsIdToken returns the token for id from the cache, if found.
+func (b *mongoBackend) statsIdToken(id int) (token string, found bool) {
+	b.cacheMu.RLock()
+	token, found = b.statsTokenNew[id]
+	if found {
+		b.cacheMu.RUnlock()
+		return
+	}
+	token, found = b.statsTokenOld[id]
+	b.cacheMu.RUnlock()
+	if found {
+		b.cacheStatsTokenId(token, id)
+	}
+	return
+}
+
+// maybeConflict returns an ErrUpdateConflict if err is a mgo
+// insert conflict LastError, or err itself otherwise.
+func maybeConflict(err error) error {
+	if lerr, ok := err.(*mgo.LastError); ok && lerr.Code == 11000 {
+		return ErrUpdateConflict
+	}
+	return err
+}
+
+// locksHeld returns whether the update locks over all of urls are held
+// with token.
+func (s *storeSession) locksHeld(urls []*charm.URL, token string) (bool, error) {
+	keys := make([]string, len(urls))
+	for i, url := range urls {
+		keys[i] = url.String()
+	}
+	n, err := s.Locks().Find(bson.D{{"_id", bson.D{{"$in", keys}}}, {"token", token}}).Count()
+	if err != nil {
+		return false, err
+	}
+	return n == len(keys), nil
+}
+
+// removeStaleCharms removes the pending charm documents that hold the
+// revision of doc at any of its URLs, and whose locks aren't held
+// anymore. It returns whether any document was removed.
+func (s *storeSession) removeStaleCharms(doc *CharmDoc) (removed bool, err error) {
+	query := bson.D{
+		{"urls", bson.D{{"$in", doc.URLs}}},
+		{"revision", doc.Revision},
+		{"locktoken", bson.D{{"$exists", true}}},
+	}
+	var pending []pendingCharmDoc
+	if err := s.Charms().Find(query).All(&pending); err != nil {
+		return false, err
+	}
+	for _, p := range pending {
+		held, err := s.locksHeld(p.URLs, p.LockToken)
+		if err != nil {
+			return removed, err
+		}
+		if held {
+			continue
+		}
+		err = s.Charms().Remove(bson.D{{"revision", p.Revision}, {"locktoken", p.LockToken}})
+		if err != nil && err != mgo.ErrNotFound {
+			return removed, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
+
+// storeSession wraps a mgo.Session ands adds a few convenience methods.
+type storeSession struct {
+	*mgo.Session
+}
+
+// Copy copies the storeSession and its underlying mgo session.
+func (s *storeSession) Copy() *storeSession {
+	return &storeSession{s.Session.Copy()}
+}
+
+// Charms returns the mongo collection where charms are stored.
+func (s *storeSession) Charms() *mgo.Collection {
+	return s.DB("juju").C("charms")
+}
+
+// CharmFS returns a mgo.GridFS to read and write charms.
+func (s *storeSession) CharmFS() *mgo.GridFS {
+	return s.DB("juju").GridFS("charmfs")
+}
+
+// BlobRefs returns the mongo collection where the reference counts
+// of charm files are stored.
+func (s *storeSession) BlobRefs() *mgo.Collection {
+	return s.DB("juju").C("blobs")
+}
+
+// DeleteIntents returns the mongo collection where pending charm
+// deletions are recorded.
+func (s *storeSession) DeleteIntents() *mgo.Collection {
+	return s.DB("juju").C("deletes")
+}
+
+// Events returns the mongo collection where charm events are stored.
+func (s *storeSession) Events() *mgo.Collection {
+	return s.DB("juju").C("events")
+}
+
+// Locks returns the mongo collection where charm locks are stored.
+func (s *storeSession) Locks() *mgo.Collection {
+	return s.DB("juju").C("locks")
+}
+
+// Jobs returns the mongo collection where the publish queue is stored.
+func (s *storeSession) Jobs() *mgo.Collection {
+	return s.DB("juju").C("jobs")
+}
+
+// Syncs returns the mongo collection where the times of the last
+// syncs with external sources are stored.
+func (s *storeSession) Syncs() *mgo.Collection {
+	return s.DB("juju").C("syncs")
+}
+
+// StatTokens returns the mongo collection for storing key tokens
+// for statistics collection.
+func (s *storeSession) StatTokens() *mgo.Collection {
+	return s.DB("juju").C("stat.tokens")
+}
+
+// StatCounters returns the mongo collection for counter values.
+func (s *storeSession) StatCounters() *mgo.Collection {
+	return s.DB("juju").C("stat.counters")
+}
@@ -0,0 +1,228 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// BundlePolicy restricts the charm bundles that may be published.
+// The zero value allows any bundle.
+type BundlePolicy struct {
+	// MaxSize holds the maximum size of charm bundles, in bytes.
+	// If zero, there's no limit.
+	MaxSize int64 `yaml:"max-size"`
+
+	// MaxFiles holds the maximum number of files in charm bundles.
+	// If zero, there's no limit.
+	MaxFiles int `yaml:"max-files"`
+
+	// ForbidBinaries forbids executable binary files in charms.
+	ForbidBinaries bool `yaml:"forbid-binaries"`
+
+	// ForbidEscapingLinks forbids symbolic links that point to
+	// files outside of the charm.
+	ForbidEscapingLinks bool `yaml:"forbid-escaping-links"`
+}
+
+// The rules a PolicyError may report as broken.
+const (
+	PolicyMaxSize  = "max-size"
+	PolicyMaxFiles = "max-files"
+	PolicyBinary   = "binary"
+	PolicyLink     = "link"
+)
+
+// PolicyError is returned when publishing a charm fails because it
+// doesn't comply with the bundle policy in effect. It's recorded in
+// the resulting charm event.
+type PolicyError struct {
+	// Rule holds the rule broken, as one of the Policy* constants.
+	Rule string
+
+	// Path holds the charm file that broke the rule, if any.
+	Path string `bson:",omitempty"`
+
+	// Limit holds the limit exceeded, for the max-size and
+	// max-files rules.
+	Limit int64 `bson:",omitempty"`
+
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// SetBundlePolicy sets the policy charm bundles must comply with to be
+// published, unless a different policy is set for their owner.
+func (s *Store) SetBundlePolicy(policy BundlePolicy) {
+	s.policy = policy
+}
+
+// SetUserBundlePolicy sets the policy bundles of charms owned by user
+// must comply with to be published.
+func (s *Store) SetUserBundlePolicy(user string, policy BundlePolicy) {
+	if s.userPolicies == nil {
+		s.userPolicies = make(map[string]BundlePolicy)
+	}
+	s.userPolicies[user] = policy
+}
+
+// bundlePolicy returns the policy for publishing a charm at urls. The
+// policy of the first owner with one applies.
+func (s *Store) bundlePolicy(urls []*charm.URL) BundlePolicy {
+	for _, url := range urls {
+		if policy, ok := s.userPolicies[url.User]; ok && url.User != "" {
+			return policy
+		}
+	}
+	return s.policy
+}
+
+// checkSize returns a PolicyError if a bundle with the given size
+// breaks the policy.
+func (p *BundlePolicy) checkSize(size int64) *PolicyError {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return &PolicyError{
+			Rule:    PolicyMaxSize,
+			Limit:   p.MaxSize,
+			Message: fmt.Sprintf("charm bundle exceeds the maximum size of %d bytes", p.MaxSize),
+		}
+	}
+	return nil
+}
+
+// checkContent returns a PolicyError if the content of ch breaks the
+// policy. Only charm directories may be checked; the content of other
+// charms is assumed to comply.
+func (p *BundlePolicy) checkContent(ch CharmDir) error {
+	dir, ok := ch.(*charm.Dir)
+	if !ok || p.MaxFiles == 0 && !p.ForbidBinaries && !p.ForbidEscapingLinks {
+		return nil
+	}
+	files := 0
+	return filepath.Walk(dir.Path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir.Path, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		// Leave out what charm.Dir.BundleTo leaves out.
+		if rel[0] == '.' || rel == "build" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		files++
+		if p.MaxFiles > 0 && files > p.MaxFiles {
+			return &PolicyError{
+				Rule:    PolicyMaxFiles,
+				Limit:   int64(p.MaxFiles),
+				Message: fmt.Sprintf("charm has more than the maximum of %d files", p.MaxFiles),
+			}
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0 && p.ForbidEscapingLinks:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			link := path.Join(path.Dir(rel), filepath.ToSlash(target))
+			if filepath.IsAbs(target) || link == ".." || len(link) > 2 && link[:3] == "../" {
+				return &PolicyError{
+					Rule:    PolicyLink,
+					Path:    rel,
+					Message: fmt.Sprintf("charm file %s links to %q, outside of the charm", rel, target),
+				}
+			}
+		case info.Mode().IsRegular() && p.ForbidBinaries:
+			binary, err := isBinary(file)
+			if err != nil {
+				return err
+			}
+			if binary {
+				return &PolicyError{
+					Rule:    PolicyBinary,
+					Path:    rel,
+					Message: fmt.Sprintf("charm file %s is an executable binary", rel),
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// binaryMagics holds the leading bytes of the executable binary
+// formats: ELF, and Mach-O in both byte orders and widths. PE files
+// are recognized by isPE.
+var binaryMagics = [][]byte{
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+}
+
+// isBinary returns whether the file at path is an executable binary.
+func isBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 4)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	for _, magic := range binaryMagics {
+		if bytes.HasPrefix(head[:n], magic) {
+			return true, nil
+		}
+	}
+	if bytes.HasPrefix(head[:n], []byte("MZ")) {
+		return isPE(f)
+	}
+	return false, nil
+}
+
+// isPE returns whether f, which starts with the "MZ" magic of DOS
+// executables, is a PE executable. Plenty of other files start with
+// "MZ" too, so the PE signature is looked for at the offset held at
+// 0x3c, as a little-endian uint32.
+func isPE(f *os.File) (bool, error) {
+	var offset [4]byte
+	if _, err := f.ReadAt(offset[:], 0x3c); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var signature [4]byte
+	_, err := f.ReadAt(signature[:], int64(binary.LittleEndian.Uint32(offset[:])))
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return signature == [4]byte{'P', 'E', 0, 0}, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
+)
+
+// publishViolation publishes the charm at path, and checks that it
+// fails with a violation of the given rule that's recorded in the
+// charm event, leaving no bundle behind.
+func (s *StoreSuite) publishViolation(c *gc.C, path string, rule, message string) *store.PolicyError {
+	err := store.Publish(s.store, urls, store.DirSource(path), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, message)
+	violation, ok := err.(*store.PolicyError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(violation.Rule, gc.Equals, rule)
+
+	event, err := s.store.CharmEvent(urls[0], "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, false)
+	c.Assert(event.Violation, gc.DeepEquals, violation)
+
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Orphans, gc.HasLen, 0)
+	return violation
+}
+
+func (s *StoreSuite) TestPolicyMaxSize(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	s.store.SetBundlePolicy(store.BundlePolicy{MaxSize: 100})
+	violation := s.publishViolation(c, path, store.PolicyMaxSize, "charm bundle exceeds the maximum size of 100 bytes")
+	c.Assert(violation.Limit, gc.Equals, int64(100))
+}
+
+func (s *StoreSuite) TestPolicyMaxFiles(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	s.store.SetBundlePolicy(store.BundlePolicy{MaxFiles: 2})
+	violation := s.publishViolation(c, path, store.PolicyMaxFiles, "charm has more than the maximum of 2 files")
+	c.Assert(violation.Limit, gc.Equals, int64(2))
+}
+
+func (s *StoreSuite) TestPolicyBinary(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	err := ioutil.WriteFile(filepath.Join(path, "hooks", "tool"), []byte("\x7fELF\x02\x01\x01"), 0755)
+	c.Assert(err, gc.IsNil)
+	s.store.SetBundlePolicy(store.BundlePolicy{ForbidBinaries: true})
+	violation := s.publishViolation(c, path, store.PolicyBinary, "charm file hooks/tool is an executable binary")
+	c.Assert(violation.Path, gc.Equals, "hooks/tool")
+}
+
+func (s *StoreSuite) TestPolicyBinaryPE(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	s.store.SetBundlePolicy(store.BundlePolicy{ForbidBinaries: true})
+
+	// PE executables have their signature where the DOS header says.
+	data := make([]byte, 0x84)
+	copy(data, "MZ")
+	data[0x3c] = 0x80
+	copy(data[0x80:], "PE\x00\x00")
+	err := ioutil.WriteFile(filepath.Join(path, "hooks", "tool.exe"), data, 0755)
+	c.Assert(err, gc.IsNil)
+	violation := s.publishViolation(c, path, store.PolicyBinary, "charm file hooks/tool.exe is an executable binary")
+	c.Assert(violation.Path, gc.Equals, "hooks/tool.exe")
+
+	// Other files that merely start with "MZ" are fine.
+	err = ioutil.WriteFile(filepath.Join(path, "hooks", "tool.exe"), []byte("MZ is a fine start for a text file.\n"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = store.Publish(s.store, urls, store.DirSource(path), "other-rev")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestPolicyEscapingLink(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	// Links within the charm are fine.
+	err := os.Symlink("../config.yaml", filepath.Join(path, "hooks", "config"))
+	c.Assert(err, gc.IsNil)
+	err = os.Symlink("../../etc/passwd", filepath.Join(path, "hooks", "passwd"))
+	c.Assert(err, gc.IsNil)
+	s.store.SetBundlePolicy(store.BundlePolicy{ForbidEscapingLinks: true})
+	violation := s.publishViolation(c, path, store.PolicyLink, `charm file hooks/passwd links to "../../etc/passwd", outside of the charm`)
+	c.Assert(violation.Path, gc.Equals, "hooks/passwd")
+}
+
+func (s *StoreSuite) TestUserPolicy(c *gc.C) {
+	path := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	s.store.SetBundlePolicy(store.BundlePolicy{MaxSize: 100})
+	s.store.SetUserBundlePolicy("joe", store.BundlePolicy{})
+	err := store.Publish(s.store, urls, store.DirSource(path), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+
+	s.store.SetUserBundlePolicy("joe", store.BundlePolicy{MaxFiles: 1})
+	err = ioutil.WriteFile(filepath.Join(path, "timestamp"), []byte("now"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = store.Publish(s.store, urls, store.DirSource(path), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, "charm has more than the maximum of 1 files")
+}
@@ -0,0 +1,440 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// Source is a location charms may be published from, such as a
+// version control branch.
+type Source interface {
+	// Checkout retrieves the latest charm content from the source
+	// into dir, which must not exist yet, and returns the digest
+	// that uniquely identifies the retrieved content. Failures
+	// that may go away if retrieval is attempted again, such as
+	// network or command errors, must be marked with Transient;
+	// any other failure is logged and not retried.
+	Checkout(dir string) (digest string, err error)
+}
+
+// AbortableSource is a Source whose retrieval of charm content may be
+// interrupted before it completes.
+type AbortableSource interface {
+	Source
+
+	// CheckoutAbort is like Checkout, but gives up and returns
+	// ErrAborted if abort is closed before it completes.
+	CheckoutAbort(dir string, abort <-chan struct{}) (digest string, err error)
+}
+
+// ErrAborted is returned when publishing is interrupted before it
+// completes. Nothing is published or logged in that case.
+var ErrAborted = errors.New("publishing aborted")
+
+// invalidCharmError wraps errors caused by the charm content itself,
+// such as a malformed charm or a failed lint check, rather than by
+// the store or the source.
+type invalidCharmError struct {
+	err error
+}
+
+func (e *invalidCharmError) Error() string {
+	return e.err.Error()
+}
+
+// invalidCharm returns err marked as caused by the charm content. A
+// nil error is returned unchanged.
+func invalidCharm(err error) error {
+	if err == nil || isInvalidCharm(err) {
+		return err
+	}
+	return &invalidCharmError{err}
+}
+
+// isInvalidCharm returns whether err was caused by the charm content.
+// Bundle policy violations are included.
+func isInvalidCharm(err error) bool {
+	switch err.(type) {
+	case *invalidCharmError, *PolicyError:
+		return true
+	}
+	return false
+}
+
+// PublishDir publishes the charm in dir at urls in the given store.
+// The published digest is the hash of the directory content, so
+// publishing the same content again returns ErrRedundantUpdate.
+func PublishDir(store *Store, urls []*charm.URL, dir *charm.Dir) error {
+	digest, err := dirDigest(dir.Path)
+	if err != nil {
+		return err
+	}
+	return Publish(store, urls, DirSource(dir.Path), digest)
+}
+
+// PublishArchive publishes the charm in the bundle file at path at
+// urls in the given store. The published digest is the SHA256 hash of
+// the file, so publishing the same content again returns
+// ErrRedundantUpdate.
+func PublishArchive(store *Store, urls []*charm.URL, path string) error {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	return Publish(store, urls, ArchiveSource(path), digest)
+}
+
+// Publish retrieves the charm from src and publishes it at urls in the
+// given store. The digest parameter must be the most recent known
+// digest of the source content. If publishing this specific digest for
+// these URLs has been attempted already and failed permanently, the
+// publishing procedure may abort early without retrieving the charm.
+// The published digest is the one of the retrieved content, though,
+// which may differ from the digest parameter.
+//
+// Publishing attempts failing with transient errors, such as network
+// or database errors and lock conflicts, are retried according to
+// PublishRetryStrategy. All the attempts made are recorded in the
+// resulting charm event.
+func Publish(store *Store, urls []*charm.URL, src Source, digest string) error {
+	_, err := publish(store, urls, src, digest, publishOptions{})
+	return err
+}
+
+// DryRunResult describes what publishing a charm would do.
+type DryRunResult struct {
+	// URLs holds the URLs the charm would be published at.
+	URLs []*charm.URL
+
+	// Digest holds the digest of the retrieved charm content.
+	Digest string
+
+	// Revision holds the revision the charm would be assigned.
+	Revision int
+
+	// Sha256 holds the SHA256 hash of the charm bundle, and Size
+	// its size in bytes.
+	Sha256 string
+	Size   int64
+
+	// Warnings holds the problems found by the lint checks.
+	Warnings []string
+}
+
+// DryRun retrieves the charm from src and reports what publishing it
+// at urls with Publish would do, without changing the store in any
+// way. Like Publish, it returns ErrRedundantUpdate if the charm is up
+// to date, and fails if publishing the digest failed before. No
+// attempt is retried.
+func DryRun(store *Store, urls []*charm.URL, src Source, digest string) (*DryRunResult, error) {
+	return dryRun(store, urls, src, digest, publishOptions{})
+}
+
+// dryRun is like DryRun, but takes optional parameters in opts.
+func dryRun(store *Store, urls []*charm.URL, src Source, digest string, opts publishOptions) (*DryRunResult, error) {
+	p := &publisher{
+		store:  store,
+		urls:   urls,
+		src:    src,
+		digest: digest,
+		opts:   opts,
+	}
+	defer p.cleanup()
+	// The update locks aren't taken, since nothing is written.
+NewTip:
+	pub, err := p.store.CharmPublisher(p.urls, p.digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkEvent(); err != nil {
+		return nil, err
+	}
+	changed, err := p.retrieve()
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		goto NewTip
+	}
+	ch, err := charm.ReadDir(p.charmDir)
+	if err != nil {
+		return nil, invalidCharm(err)
+	}
+	p.report("linting")
+	warnings, err := p.store.lint(ch)
+	if err != nil {
+		return nil, err
+	}
+	p.report("bundling")
+	bundleSha256, size, err := pub.DryRun(ch)
+	if err != nil {
+		return nil, err
+	}
+	return &DryRunResult{
+		URLs:     p.urls,
+		Digest:   p.digest,
+		Revision: pub.Revision(),
+		Sha256:   bundleSha256,
+		Size:     size,
+		Warnings: warnings,
+	}, nil
+}
+
+// publishOptions holds optional parameters for publish.
+type publishOptions struct {
+	// abort, if not nil, interrupts publishing when closed while the
+	// charm is being retrieved or while waiting to retry. Publishing
+	// then fails with ErrAborted.
+	abort <-chan struct{}
+
+	// progress, if not nil, is called with a description of each
+	// stage of publishing as it starts.
+	progress func(stage string)
+}
+
+// publish is like Publish, but takes optional parameters in opts, and
+// returns the revision assigned to the published charm.
+func publish(store *Store, urls []*charm.URL, src Source, digest string, opts publishOptions) (revision int, err error) {
+	p := &publisher{
+		store:    store,
+		urls:     urls,
+		src:      src,
+		digest:   digest,
+		strategy: PublishRetryStrategy,
+		opts:     opts,
+	}
+	defer p.cleanup()
+	for {
+		err := p.attempt()
+		if !IsTransient(err) || p.lastAttempt() {
+			return p.revision, err
+		}
+		delay := p.strategy.delay(len(p.attempts))
+		logger.Warningf("publishing %v failed, retrying in %v: %v", urls, delay, err)
+		p.report(fmt.Sprintf("waiting %v to retry", delay))
+		select {
+		case <-time.After(delay):
+		case <-opts.abort:
+			return 0, ErrAborted
+		}
+	}
+}
+
+// publisher holds the state of a charm being published by Publish.
+type publisher struct {
+	store    *Store
+	urls     []*charm.URL
+	src      Source
+	digest   string
+	strategy RetryStrategy
+	opts     publishOptions
+	attempts []PublishAttempt
+	warnings []string
+	tempDir  string
+	charmDir string
+
+	// revision holds the revision assigned to the charm once it's
+	// published.
+	revision int
+}
+
+// cleanup removes the charm retrieved from the source, if any.
+func (p *publisher) cleanup() {
+	if p.tempDir != "" {
+		os.RemoveAll(p.tempDir)
+	}
+}
+
+// report reports that the given publishing stage has started.
+func (p *publisher) report(stage string) {
+	if p.opts.progress != nil {
+		p.opts.progress(stage)
+	}
+}
+
+// lastAttempt returns whether no further attempts may be made.
+func (p *publisher) lastAttempt() bool {
+	return len(p.attempts) >= p.strategy.Attempts
+}
+
+// attempt makes an attempt at publishing the charm. If the attempt
+// fails with a transient error and more attempts may be made, the
+// failure is only recorded in p.attempts, to be logged with the
+// outcome of further attempts.
+func (p *publisher) attempt() (err error) {
+	p.attempts = append(p.attempts, PublishAttempt{Time: time.Now()})
+	defer func() {
+		if err != nil {
+			p.attempts[len(p.attempts)-1].Error = err.Error()
+		}
+		if IsTransient(err) && p.lastAttempt() {
+			// No more attempts will be made, so make the failure
+			// known.
+			err = p.logEvent(0, err)
+		}
+	}()
+
+	// Prevent other publishers from updating these specific URLs
+	// concurrently.
+	p.report("locking")
+	lock, err := p.store.LockUpdates(p.urls)
+	if err != nil {
+		return transient(err)
+	}
+	defer lock.Unlock()
+
+NewTip:
+	// Prepare the charm publisher. This will compute the revision
+	// to be assigned to the charm, and it will also fail if the
+	// operation is unnecessary because charms are up-to-date.
+	pub, err := lock.CharmPublisher(p.digest)
+	if err == ErrRedundantUpdate {
+		return err
+	} else if err != nil {
+		return transient(err)
+	}
+
+	if err := p.checkEvent(); err != nil {
+		return err
+	}
+	changed, err := p.retrieve()
+	if isInvalidCharm(err) {
+		// Let the author know, as above.
+		return p.logEvent(0, err)
+	} else if err != nil {
+		return err
+	}
+	if changed {
+		goto NewTip
+	}
+
+	ch, err := charm.ReadDir(p.charmDir)
+	if err != nil {
+		err = invalidCharm(err)
+	} else {
+		p.report("linting")
+		p.warnings, err = p.store.lint(ch)
+	}
+	if err == nil {
+		// Hand over the charm to the store for bundling and
+		// streaming its content into the database.
+		p.report("publishing")
+		err = pub.Publish(ch)
+		if err == ErrUpdateConflict {
+			// A conflict may happen in edge cases if the whole
+			// locking mechanism fails due to an expiration event,
+			// and then the expired concurrent publisher revives
+			// for whatever reason and attempts to finish
+			// publishing. The lock is checked as the charm is
+			// recorded, which prevents it from doing so, and the
+			// error isn't logged since the new lock holder is in
+			// charge of publishing.
+			return err
+		}
+	}
+	if IsTransient(err) {
+		// Logged above if no further attempts will be made.
+		return err
+	}
+	if err == nil {
+		p.revision = pub.Revision()
+	}
+	return p.logEvent(pub.Revision(), err)
+}
+
+// checkEvent returns an error if publishing the charm was attempted
+// before and failed. We won't try again endlessly if so, unless the
+// failure was transient.
+func (p *publisher) checkEvent() error {
+	event, err := p.store.CharmEvent(p.urls[0], p.digest)
+	if err == nil && event.Kind != EventPublished && !event.Transient {
+		// Failures that weren't transient will happen again.
+		return invalidCharm(fmt.Errorf("charm publishing previously failed: %s", strings.Join(event.Errors, "; ")))
+	} else if err != nil && err != ErrNotFound {
+		return transient(err)
+	}
+	return nil
+}
+
+// retrieve retrieves the charm from the source into p.charmDir, unless
+// that was done already by a previous attempt, and sets p.digest to
+// the digest of the retrieved content. It returns whether the digest
+// changed.
+func (p *publisher) retrieve() (changed bool, err error) {
+	if p.charmDir != "" {
+		return false, nil
+	}
+	if p.tempDir == "" {
+		p.tempDir, err = ioutil.TempDir("", "publish-")
+		if err != nil {
+			return false, err
+		}
+	}
+	charmDir := filepath.Join(p.tempDir, "charm")
+
+	// Pick actual digest from the retrieved content. Publishing
+	// the real tip revision rather than the revision for the
+	// digest provided is strictly necessary to prevent a race
+	// condition. If the provided digest was published instead,
+	// there's a chance another publisher concurrently running
+	// could have found a newer revision and published that
+	// first, and the digest parameter provided is in fact an old
+	// version that would overwrite the new version.
+	p.report("retrieving")
+	var tipDigest string
+	if src, ok := p.src.(AbortableSource); ok {
+		tipDigest, err = src.CheckoutAbort(charmDir, p.opts.abort)
+	} else {
+		tipDigest, err = p.src.Checkout(charmDir)
+	}
+	if err != nil {
+		// Leave no partial content behind for the next attempt.
+		os.RemoveAll(charmDir)
+		return false, err
+	}
+	// The retrieved charm is kept for further attempts.
+	p.charmDir = charmDir
+	if tipDigest != p.digest {
+		p.digest = tipDigest
+		return true, nil
+	}
+	return false, nil
+}
+
+// logEvent logs the outcome of publishing the charm, and returns err
+// combined with any error logging it.
+func (p *publisher) logEvent(revision int, err error) error {
+	event := &CharmEvent{
+		URLs:     p.urls,
+		Digest:   p.digest,
+		Warnings: p.warnings,
+		Attempts: p.attempts,
+	}
+	if err == nil {
+		event.Kind = EventPublished
+		event.Revision = revision
+	} else {
+		event.Kind = EventPublishError
+		event.Errors = []string{err.Error()}
+		event.Transient = IsTransient(err)
+		event.Violation, _ = err.(*PolicyError)
+	}
+	if logerr := p.store.LogCharmEvent(event); logerr != nil {
+		if err == nil {
+			err = logerr
+		} else {
+			err = fmt.Errorf("%v; %v", err, logerr)
+		}
+	}
+	return err
+}
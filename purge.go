@@ -0,0 +1,54 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"time"
+)
+
+// PurgeInterval is how often soft-deleted charms are purged once
+// StartPurging is called.
+var PurgeInterval = time.Hour
+
+// StartPurging purges every PurgeInterval, until the store is closed,
+// the charm revisions soft-deleted more than age ago. Stores opened
+// with OpenConfig purge them according to Config.PurgeAge. It must not
+// be called more than once for a store.
+func (s *Store) StartPurging(age time.Duration) {
+	if s.purgeStop != nil {
+		panic("store is already purging deleted charms")
+	}
+	s.purgeStop = make(chan struct{})
+	s.purgeDone = make(chan struct{})
+	go s.purgeLoop(age, s.purgeStop, s.purgeDone)
+}
+
+func (s *Store) purgeLoop(age time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		purged, err := s.PurgeDeletedCharms(age)
+		if err != nil {
+			logger.Errorf("cannot purge deleted charms: %v", err)
+		}
+		if len(purged) > 0 {
+			logger.Infof("purged %d deleted charm revisions", len(purged))
+		}
+	}
+}
+
+// stopPurging stops the purging started by StartPurging, if any.
+func (s *Store) stopPurging() {
+	if s.purgeStop != nil {
+		close(s.purgeStop)
+		<-s.purgeDone
+		s.purgeStop = nil
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// JobState describes the progress of a publishing job.
+type JobState string
+
+const (
+	JobPending JobState = "pending"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// JobStates holds all the possible job states.
+var JobStates = []JobState{JobPending, JobRunning, JobDone, JobFailed}
+
+// PublishJob is a request to publish a charm, held in the publish
+// queue of a store until a QueueWorker handles it.
+type PublishJob struct {
+	Id     string `bson:"_id"`
+	URLs   []*charm.URL
+	Source JobSource
+	Digest string
+	State  JobState
+
+	// Owner identifies the worker running the job, which has it
+	// reserved until Lease. Once the lease expires, the job may be
+	// claimed by another worker.
+	Owner string `bson:",omitempty"`
+	Lease time.Time
+
+	// Timeout, if not zero, holds how long the job may run before
+	// it's given up on, failing transiently.
+	Timeout time.Duration `bson:",omitempty"`
+
+	// Progress describes the publishing stage a running job is at.
+	Progress string `bson:",omitempty"`
+
+	// Revision holds the revision assigned to the charm by a done
+	// job, unless Redundant is set because the charm was already
+	// up-to-date.
+	Revision  int  `bson:",omitempty"`
+	Redundant bool `bson:",omitempty"`
+
+	// Error holds the reason why a failed job failed. Transient holds
+	// whether the failure may go away if the job is run again, and
+	// Invalid whether it was caused by the charm content.
+	Error     string `bson:",omitempty"`
+	Transient bool   `bson:",omitempty"`
+	Invalid   bool   `bson:",omitempty"`
+
+	Created time.Time
+	Updated time.Time
+}
+
+// Err returns the outcome of the finished job as the error publishing
+// would have returned: nil, ErrRedundantUpdate, or an error classified
+// as IsTransient would have it.
+func (job *PublishJob) Err() error {
+	switch {
+	case job.State == JobDone && job.Redundant:
+		return ErrRedundantUpdate
+	case job.State == JobDone:
+		return nil
+	case job.State != JobFailed:
+		return fmt.Errorf("publish job %s is %s", job.Id, job.State)
+	}
+	err := errors.New(job.Error)
+	if job.Transient {
+		return transient(err)
+	}
+	if job.Invalid {
+		return invalidCharm(err)
+	}
+	return err
+}
+
+// JobSource describes the source a job publishes a charm from.
+// Location is interpreted according to Kind, which is one of the
+// SourceBazaar, SourceGit, SourceTarball, SourceDir, SourceArchive and
+// SourceUpload constants. The location of an upload is the id of the
+// blob holding the uploaded bundle, which is removed once the job is
+// finished.
+type JobSource struct {
+	Kind     string
+	Location string
+}
+
+const (
+	SourceBazaar  = "bzr"
+	SourceGit     = "git"
+	SourceTarball = "tarball"
+	SourceDir     = "dir"
+	SourceArchive = "archive"
+	SourceUpload  = "upload"
+)
+
+// source returns the Source described by src, which retrieves charms
+// from store if src is an upload.
+func (src JobSource) source(store *Store) (Source, error) {
+	switch src.Kind {
+	case SourceBazaar:
+		return BazaarSource(src.Location), nil
+	case SourceGit:
+		return GitSource(src.Location), nil
+	case SourceTarball:
+		return TarballSource(src.Location), nil
+	case SourceDir:
+		return DirSource(src.Location), nil
+	case SourceArchive:
+		return ArchiveSource(src.Location), nil
+	case SourceUpload:
+		return uploadSource{store, BlobId(src.Location)}, nil
+	}
+	return nil, fmt.Errorf("unknown source kind %q", src.Kind)
+}
+
+// uploadSource is a Source that retrieves charms from the bundle held
+// in the given blob of store.
+type uploadSource struct {
+	store *Store
+	id    BlobId
+}
+
+// Checkout implements Source.Checkout.
+func (src uploadSource) Checkout(dir string) (digest string, err error) {
+	r, err := src.store.backend.OpenBlob(src.id)
+	if err == ErrNotFound {
+		return "", fmt.Errorf("uploaded charm bundle %s not found", src.id)
+	} else if err != nil {
+		return "", transient(err)
+	}
+	defer r.Close()
+
+	// The bundle must be read as a zip, so it's saved to a file.
+	f, err := ioutil.TempFile("", "publish-upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", transient(err)
+	}
+	return ArchiveSource(f.Name()).Checkout(dir)
+}
+
+// EnqueuePublish adds to the publish queue a job for publishing the
+// charm from src at urls. The digest parameter is handled as by
+// Publish.
+func (s *Store) EnqueuePublish(urls []*charm.URL, src JobSource, digest string) (*PublishJob, error) {
+	return s.enqueuePublish(urls, src, digest, 0)
+}
+
+// enqueuePublish is like EnqueuePublish, but the job is given up on if
+// it runs for longer than timeout, unless timeout is zero.
+func (s *Store) enqueuePublish(urls []*charm.URL, src JobSource, digest string, timeout time.Duration) (*PublishJob, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no charm URLs provided")
+	}
+	if err := mustLackRevision("EnqueuePublish", urls...); err != nil {
+		return nil, err
+	}
+	if _, err := src.source(s); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &PublishJob{
+		Id:      bson.NewObjectId().Hex(),
+		URLs:    urls,
+		Source:  src,
+		Digest:  digest,
+		State:   JobPending,
+		Timeout: timeout,
+		Created: now,
+		Updated: now,
+	}
+	if err := s.backend.InsertJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// enqueueUpload stores the charm bundle read from r, which must have
+// the given SHA256 hash, and adds to the publish queue a job for
+// publishing it at urls.
+func (s *Store) enqueueUpload(urls []*charm.URL, r io.Reader, sha256 string) (*PublishJob, error) {
+	w, err := s.backend.CreateBlob()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	id, err := w.Finish(sha256)
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.EnqueuePublish(urls, JobSource{Kind: SourceUpload, Location: string(id)}, sha256)
+	if err != nil {
+		if err := s.backend.RemoveBlob(id); err != nil {
+			logger.Errorf("cannot remove uploaded charm bundle %s: %v", id, err)
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// queuedUploads returns the ids of the blobs holding the uploaded
+// charms of the jobs in the publish queue that aren't finished yet.
+func (s *Store) queuedUploads() (map[BlobId]bool, error) {
+	jobs, err := s.backend.FindJobs(JobPending, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[BlobId]bool)
+	for _, job := range jobs {
+		if job.Source.Kind == SourceUpload {
+			ids[BlobId(job.Source.Location)] = true
+		}
+	}
+	return ids, nil
+}
+
+// JobPollDelay is how often the state of a publish job is checked
+// while waiting for it to finish.
+var JobPollDelay = 250 * time.Millisecond
+
+// waitJob waits until the job with the given id is done or failed, and
+// returns it. If stop is closed first, the job is returned as last
+// found.
+func (s *Store) waitJob(id string, stop <-chan struct{}) (*PublishJob, error) {
+	for {
+		job, err := s.backend.FindJob(id)
+		if err != nil {
+			return nil, err
+		}
+		if job.State == JobDone || job.State == JobFailed {
+			return job, nil
+		}
+		select {
+		case <-time.After(JobPollDelay):
+		case <-stop:
+			return job, nil
+		}
+	}
+}
+
+// PublishJob returns the job in the publish queue with the given id.
+// If no such job exists, the error ErrNotFound is returned.
+func (s *Store) PublishJob(id string) (*PublishJob, error) {
+	return s.backend.FindJob(id)
+}
+
+// QueueDepth returns the number of jobs in the publish queue in each
+// of the possible states.
+func (s *Store) QueueDepth() (map[JobState]int, error) {
+	return s.backend.JobCounts()
+}
+
+// JobLease is how long a job claimed by a QueueWorker stays reserved
+// to it without being renewed. Running jobs are renewed at a third of
+// this period.
+var JobLease = 2 * time.Minute
+
+// QueuePollDelay is how long a QueueWorker waits before looking for
+// jobs again once the publish queue is found empty.
+var QueuePollDelay = 10 * time.Second
+
+// QueueWorker runs jobs from the publish queue of a store, one at a
+// time, until stopped. Any number of workers may consume the same
+// queue concurrently.
+type QueueWorker struct {
+	store *Store
+	owner string
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewQueueWorker starts a worker that runs jobs from the publish queue
+// of store. The owner parameter must uniquely identify the worker.
+func NewQueueWorker(store *Store, owner string) *QueueWorker {
+	w := &QueueWorker{
+		store: store,
+		owner: owner,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// Stop stops the worker. A job being run is interrupted and put back in
+// the queue, so that it may be run again.
+func (w *QueueWorker) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// Wake makes the worker look for jobs right away if it's waiting for
+// the publish queue to have some, rather than after QueuePollDelay.
+func (w *QueueWorker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *QueueWorker) loop() {
+	defer close(w.done)
+	for {
+		// An interrupted job is put back in the queue, so it must
+		// not be claimed again once the worker is stopping.
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		now := time.Now()
+		job, err := w.store.backend.ClaimJob(w.owner, now, now.Add(JobLease))
+		if err == nil {
+			w.run(job)
+			continue
+		}
+		if err != ErrNotFound {
+			logger.Errorf("cannot claim publish job: %v", err)
+		}
+		select {
+		case <-time.After(QueuePollDelay):
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// run runs job, which must be claimed by the worker, and records its
+// outcome. The job lease is renewed while it runs, and if the job is
+// lost to another worker or runs out of time, it's interrupted.
+func (w *QueueWorker) run(job *PublishJob) {
+	logger.Infof("running publish job %s for %v", job.Id, job.URLs)
+	src, err := job.Source.source(w.store)
+	if err != nil {
+		w.finish(job, 0, err)
+		return
+	}
+	var mu sync.Mutex
+	progress := ""
+	abort := make(chan struct{})
+	done := make(chan struct{})
+	renewed := make(chan bool, 1)
+	var timeout <-chan time.Time
+	if job.Timeout > 0 {
+		timer := time.NewTimer(job.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	timedOut := false
+	go func() {
+		ticker := time.NewTicker(JobLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-timeout:
+				timedOut = true
+				close(abort)
+				renewed <- true
+				return
+			case <-w.stop:
+				close(abort)
+				renewed <- true
+				return
+			case <-done:
+				renewed <- true
+				return
+			}
+			mu.Lock()
+			renewal := *job
+			renewal.Progress = progress
+			mu.Unlock()
+			renewal.Updated = time.Now()
+			renewal.Lease = renewal.Updated.Add(JobLease)
+			if err := w.store.backend.UpdateJob(&renewal); err != nil {
+				logger.Errorf("cannot renew publish job %s: %v", job.Id, err)
+				if err == ErrUpdateConflict {
+					// Another worker claimed the job.
+					close(abort)
+					renewed <- false
+					return
+				}
+			}
+		}
+	}()
+	opts := publishOptions{
+		abort: abort,
+		progress: func(stage string) {
+			mu.Lock()
+			progress = stage
+			mu.Unlock()
+		},
+	}
+	revision, err := publish(w.store, job.URLs, src, job.Digest, opts)
+	close(done)
+	if !<-renewed {
+		logger.Errorf("publish job %s was lost to another worker", job.Id)
+		return
+	}
+	if err == ErrAborted && timedOut {
+		err = transient(fmt.Errorf("publishing timed out after %v", job.Timeout))
+	}
+	w.finish(job, revision, err)
+}
+
+// finish records the outcome of running job, which published the
+// charm at the given revision if err is nil.
+func (w *QueueWorker) finish(job *PublishJob, revision int, err error) {
+	job.Updated = time.Now()
+	job.Lease = job.Updated
+	job.Progress = ""
+	switch err {
+	case nil:
+		job.State = JobDone
+		job.Revision = revision
+	case ErrRedundantUpdate:
+		job.State = JobDone
+		job.Redundant = true
+	case ErrAborted:
+		// The worker was stopped.
+		job.State = JobPending
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+		job.Transient = IsTransient(err)
+		job.Invalid = isInvalidCharm(err)
+		logger.Errorf("publish job %s failed: %v", job.Id, err)
+	}
+	if err := w.store.backend.UpdateJob(job); err != nil {
+		logger.Errorf("cannot record outcome of publish job %s: %v", job.Id, err)
+		return
+	}
+	if job.Source.Kind == SourceUpload && job.State != JobPending {
+		if err := w.store.backend.RemoveBlob(BlobId(job.Source.Location)); err != nil && err != ErrNotFound {
+			logger.Errorf("cannot remove uploaded charm bundle %s: %v", job.Source.Location, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
+)
+
+// waitJob waits until the job with the given id is neither pending nor
+// running, and returns it.
+func (s *StoreSuite) waitJob(c *gc.C, id string) *store.PublishJob {
+	timeout := time.After(10 * time.Second)
+	for {
+		job, err := s.store.PublishJob(id)
+		c.Assert(err, gc.IsNil)
+		if job.State != store.JobPending && job.State != store.JobRunning {
+			return job
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("job %s still %s", id, job.State)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *StoreSuite) TestPublishQueue(c *gc.C) {
+	s.PatchValue(&store.QueuePollDelay, 10*time.Millisecond)
+	good := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	bad := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	err := os.Remove(filepath.Join(bad, "metadata.yaml"))
+	c.Assert(err, gc.IsNil)
+
+	job1, err := s.store.EnqueuePublish(urls, store.JobSource{Kind: store.SourceDir, Location: good}, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(job1.State, gc.Equals, store.JobPending)
+	job2, err := s.store.EnqueuePublish(urls[:1], store.JobSource{Kind: store.SourceDir, Location: bad}, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+
+	depth, err := s.store.QueueDepth()
+	c.Assert(err, gc.IsNil)
+	c.Assert(depth, gc.DeepEquals, map[store.JobState]int{
+		store.JobPending: 2,
+		store.JobRunning: 0,
+		store.JobDone:    0,
+		store.JobFailed:  0,
+	})
+
+	worker := store.NewQueueWorker(s.store, "worker-1")
+	defer worker.Stop()
+
+	job1 = s.waitJob(c, job1.Id)
+	c.Assert(job1.State, gc.Equals, store.JobDone)
+	c.Assert(job1.Owner, gc.Equals, "worker-1")
+	c.Assert(job1.Error, gc.Equals, "")
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	event, err := s.store.CharmEvent(urls[0], info.Digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+
+	job2 = s.waitJob(c, job2.Id)
+	c.Assert(job2.State, gc.Equals, store.JobFailed)
+	c.Assert(job2.Error, gc.Matches, ".*/metadata.yaml: no such file or directory")
+
+	depth, err = s.store.QueueDepth()
+	c.Assert(err, gc.IsNil)
+	c.Assert(depth[store.JobDone], gc.Equals, 1)
+	c.Assert(depth[store.JobFailed], gc.Equals, 1)
+}
+
+func (s *StoreSuite) TestQueueWorkerStop(c *gc.C) {
+	s.PatchValue(&store.QueuePollDelay, 10*time.Millisecond)
+	s.PatchValue(&store.PublishRetryStrategy, store.RetryStrategy{Attempts: 3, Delay: time.Hour, MaxDelay: time.Hour})
+	calls := make(chan bool, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- true
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	src := store.JobSource{Kind: store.SourceTarball, Location: server.URL}
+	job1, err := s.store.EnqueuePublish(urls, src, "rev1")
+	c.Assert(err, gc.IsNil)
+	job2, err := s.store.EnqueuePublish(urls, src, "rev2")
+	c.Assert(err, gc.IsNil)
+
+	// Stop the worker while it waits to retry the first job.
+	worker := store.NewQueueWorker(s.store, "worker-1")
+	select {
+	case <-calls:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("job never ran")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		worker.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("worker didn't stop")
+	}
+
+	// Both jobs are left for other workers.
+	for _, id := range []string{job1.Id, job2.Id} {
+		job, err := s.store.PublishJob(id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(job.State, gc.Equals, store.JobPending)
+	}
+}
+
+func (s *StoreSuite) TestEnqueuePublishErrors(c *gc.C) {
+	_, err := s.store.EnqueuePublish(nil, store.JobSource{Kind: store.SourceDir, Location: "/some/dir"}, "")
+	c.Assert(err, gc.ErrorMatches, "no charm URLs provided")
+	_, err = s.store.EnqueuePublish(urls, store.JobSource{Kind: "svn", Location: "/some/dir"}, "")
+	c.Assert(err, gc.ErrorMatches, `unknown source kind "svn"`)
+	_, err = s.store.PublishJob("unknown")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestClaimJob(c *gc.C) {
+	backend := store.StoreBackend(s.store)
+	job, err := s.store.EnqueuePublish(urls, store.JobSource{Kind: store.SourceDir, Location: "/some/dir"}, "")
+	c.Assert(err, gc.IsNil)
+
+	now := time.Now()
+	claimed, err := backend.ClaimJob("worker-1", now, now.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(claimed.Id, gc.Equals, job.Id)
+	c.Assert(claimed.State, gc.Equals, store.JobRunning)
+	c.Assert(claimed.Owner, gc.Equals, "worker-1")
+
+	// The job is reserved while the lease lasts.
+	_, err = backend.ClaimJob("worker-2", now.Add(30*time.Second), now.Add(time.Minute))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// Once it expires, the job may be claimed by another worker, and
+	// the previous owner can't update it anymore.
+	later := now.Add(2 * time.Minute)
+	stolen, err := backend.ClaimJob("worker-2", later, later.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(stolen.Id, gc.Equals, job.Id)
+	c.Assert(stolen.Owner, gc.Equals, "worker-2")
+
+	claimed.State = store.JobDone
+	err = backend.UpdateJob(claimed)
+	c.Assert(err, gc.Equals, store.ErrUpdateConflict)
+
+	stolen.State = store.JobDone
+	err = backend.UpdateJob(stolen)
+	c.Assert(err, gc.IsNil)
+	found, err := s.store.PublishJob(job.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(found.State, gc.Equals, store.JobDone)
+
+	// Finished jobs aren't claimed again.
+	_, err = backend.ClaimJob("worker-1", later.Add(time.Hour), later.Add(2*time.Hour))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestServerPublishQueue(c *gc.C) {
+	server, err := store.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	job, err := s.store.EnqueuePublish(urls, store.JobSource{Kind: store.SourceBazaar, Location: "lp:some/branch"}, "rev1")
+	c.Assert(err, gc.IsNil)
+
+	do := func(path, user string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, gc.IsNil)
+		req.SetBasicAuth(user, "secret")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The endpoints are disabled by default.
+	rec := do("/publish-queue", "admin")
+	c.Assert(rec.Code, gc.Equals, http.StatusForbidden)
+	rec = do("/publish-job/"+job.Id, "admin")
+	c.Assert(rec.Code, gc.Equals, http.StatusForbidden)
+
+	server.SetAdminAuth(func(user, password string) bool {
+		return user == "admin" && password == "secret"
+	})
+	server.SetUploadAuth(func(user, password string) bool {
+		return user == "uploader" && password == "secret"
+	})
+	rec = do("/publish-queue", "uploader")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized)
+	rec = do("/publish-queue", "admin")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+	var depth map[string]int
+	err = json.NewDecoder(rec.Body).Decode(&depth)
+	c.Assert(err, gc.IsNil)
+	c.Assert(depth, gc.DeepEquals, map[string]int{"pending": 1, "running": 0, "done": 0, "failed": 0})
+
+	// Uploaders may follow jobs too.
+	for _, user := range []string{"admin", "uploader"} {
+		rec = do("/publish-job/"+job.Id, user)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		var response store.JobResponse
+		err = json.NewDecoder(rec.Body).Decode(&response)
+		c.Assert(err, gc.IsNil)
+		c.Assert(response.Id, gc.Equals, job.Id)
+		c.Assert(response.URLs, gc.DeepEquals, []string{urls[0].String(), urls[1].String()})
+		c.Assert(response.Digest, gc.Equals, "rev1")
+		c.Assert(response.State, gc.Equals, "pending")
+	}
+	rec = do("/publish-job/"+job.Id, "joe")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized)
+
+	rec = do("/publish-job/unknown", "admin")
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"time"
+)
+
+// transientError wraps errors that may go away if the failed operation
+// is attempted again, such as network or database errors.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// transient returns err marked as transient. A nil error is returned
+// unchanged.
+func transient(err error) error {
+	if err == nil || IsTransient(err) {
+		return err
+	}
+	return &transientError{err}
+}
+
+// Transient returns err marked as transient, so that Source
+// implementations may report retrieval failures that are worth
+// retrying. A nil error is returned unchanged.
+func Transient(err error) error {
+	return transient(err)
+}
+
+// IsTransient returns whether err may go away if the failed operation
+// is attempted again.
+func IsTransient(err error) bool {
+	_, ok := err.(*transientError)
+	return ok
+}
+
+// RetryStrategy describes how operations failing with transient errors
+// are retried.
+type RetryStrategy struct {
+	// Attempts holds the maximum number of attempts made.
+	Attempts int
+
+	// Delay holds how long to wait before the first retry. It's
+	// doubled for each further retry, up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// PublishRetryStrategy is the strategy used by Publish.
+var PublishRetryStrategy = RetryStrategy{
+	Attempts: 5,
+	Delay:    5 * time.Second,
+	MaxDelay: 2 * time.Minute,
+}
+
+// delay returns how long to wait before the given retry, counting
+// from one.
+func (s RetryStrategy) delay(retry int) time.Duration {
+	d := s.Delay
+	for i := 1; i < retry && d < s.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > s.MaxDelay {
+		d = s.MaxDelay
+	}
+	return d
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// ScrubReport describes the inconsistencies found by Store.Scrub.
+type ScrubReport struct {
+	// Charms holds the number of charm revisions checked.
+	Charms int
+
+	// Missing holds the charms whose bundle blob doesn't exist.
+	Missing []*ScrubProblem
+
+	// Corrupt holds the charms whose bundle blob doesn't match the
+	// size or SHA256 hash recorded for the charm.
+	Corrupt []*ScrubProblem
+
+	// Orphans holds the ids of the blobs no charm refers to. Blobs
+	// holding uploaded charms that wait in the publish queue aren't
+	// orphans.
+	Orphans []BlobId
+
+	// BadRefs holds the blob reference counts that don't match the
+	// charms referring to the blobs. The Refs field of each entry
+	// holds the expected count.
+	BadRefs []*BlobRef
+
+	// Repaired holds whether the orphans were removed and the bad
+	// reference counts fixed.
+	Repaired bool
+}
+
+// ScrubProblem describes a problem found with the bundle of a charm.
+type ScrubProblem struct {
+	URLs     []*charm.URL
+	Revision int
+	BlobId   BlobId
+	Problem  string
+}
+
+// blobKey identifies a blob by content hash and id.
+type blobKey struct {
+	sha256 string
+	id     BlobId
+}
+
+// blobCheck holds the result of checking a blob.
+type blobCheck struct {
+	missing bool
+	size    int64
+	sha256  string
+}
+
+// Scrub checks the consistency between the stored charms and their
+// bundles. Every bundle is read back and verified against the size
+// and hash recorded for its charms, and the blobs that no charm refers
+// to are reported, as are reference counts that don't match.
+//
+// If repair is true, the orphaned blobs are removed and the reference
+// counts are fixed. Charms with missing or corrupt bundles are only
+// reported, since fixing them needs the charm to be published again.
+// Repairing must not be done while charms are being published,
+// deleted or uploaded, as blobs just written may not yet be referred
+// to.
+func (s *Store) Scrub(repair bool) (*ScrubReport, error) {
+	report := &ScrubReport{}
+	checks := make(map[BlobId]*blobCheck)
+	refs := make(map[blobKey]int)
+	err := s.backend.IterCharms(func(doc *CharmDoc) error {
+		report.Charms++
+		check, ok := checks[doc.FileId]
+		if !ok {
+			var err error
+			check, err = s.checkBlob(doc.FileId)
+			if err != nil {
+				return err
+			}
+			checks[doc.FileId] = check
+		}
+		problem := &ScrubProblem{
+			URLs:     doc.URLs,
+			Revision: doc.Revision,
+			BlobId:   doc.FileId,
+		}
+		switch {
+		case check.missing:
+			problem.Problem = "bundle not found"
+			report.Missing = append(report.Missing, problem)
+		case check.size != doc.Size:
+			problem.Problem = fmt.Sprintf("bundle has size %d, expected %d", check.size, doc.Size)
+			report.Corrupt = append(report.Corrupt, problem)
+		case check.sha256 != doc.Sha256:
+			problem.Problem = fmt.Sprintf("bundle has hash %s, expected %s", check.sha256, doc.Sha256)
+			report.Corrupt = append(report.Corrupt, problem)
+		}
+		refs[blobKey{doc.Sha256, doc.FileId}]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.backend.BlobIds()
+	if err != nil {
+		return nil, err
+	}
+	// The jobs are found after the blobs, so that the blob of an
+	// upload queued in between isn't taken as an orphan.
+	queued, err := s.queuedUploads()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := checks[id]; !ok && !queued[id] {
+			report.Orphans = append(report.Orphans, id)
+		}
+	}
+
+	// Charms with no reference count recorded for their bundle were
+	// stored before blobs were shared, and are left alone.
+	blobRefs, err := s.backend.BlobRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range blobRefs {
+		want := refs[blobKey{ref.Sha256, ref.BlobId}]
+		if ref.Refs != want {
+			report.BadRefs = append(report.BadRefs, &BlobRef{Sha256: ref.Sha256, BlobId: ref.BlobId, Refs: want})
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+
+	for _, id := range report.Orphans {
+		logger.Infof("removing orphaned blob %s", id)
+		if err := s.backend.RemoveBlob(id); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	for _, ref := range report.BadRefs {
+		logger.Infof("setting reference count of blob %s to %d", ref.BlobId, ref.Refs)
+		if err := s.backend.SetBlobRef(ref); err != nil {
+			return nil, err
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// checkBlob reads the blob with the given id and returns its size and
+// hash.
+func (s *Store) checkBlob(id BlobId) (*blobCheck, error) {
+	r, err := s.backend.OpenBlob(id)
+	if err == ErrNotFound {
+		return &blobCheck{missing: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob %s: %v", id, err)
+	}
+	return &blobCheck{size: size, sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
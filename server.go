@@ -4,10 +4,15 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -20,8 +25,10 @@ const DefaultSeries = "precise"
 // Server is an http.Handler that serves the HTTP API of juju
 // so that juju clients can retrieve published charms.
 type Server struct {
-	store *Store
-	mux   *http.ServeMux
+	store      *Store
+	mux        *http.ServeMux
+	uploadAuth func(user, password string) bool
+	adminAuth  func(user, password string) bool
 }
 
 // NewServer returns a new *Server using store.
@@ -39,6 +46,21 @@ func NewServer(store *Store) (*Server, error) {
 	s.mux.HandleFunc("/charm/", func(w http.ResponseWriter, r *http.Request) {
 		s.serveCharm(w, r)
 	})
+	s.mux.HandleFunc("/charm-upload", func(w http.ResponseWriter, r *http.Request) {
+		s.serveUpload(w, r)
+	})
+	s.mux.HandleFunc("/publish-queue", func(w http.ResponseWriter, r *http.Request) {
+		s.serveQueue(w, r)
+	})
+	s.mux.HandleFunc("/publish-job/", func(w http.ResponseWriter, r *http.Request) {
+		s.serveJob(w, r)
+	})
+	s.mux.HandleFunc("/admin/locks", func(w http.ResponseWriter, r *http.Request) {
+		s.serveLocks(w, r)
+	})
+	s.mux.HandleFunc("/stats/writer", func(w http.ResponseWriter, r *http.Request) {
+		s.serveStatsWriter(w, r)
+	})
 	s.mux.HandleFunc("/stats/counter/", func(w http.ResponseWriter, r *http.Request) {
 		s.serveStats(w, r)
 	})
@@ -51,6 +73,24 @@ func NewServer(store *Store) (*Server, error) {
 	return s, nil
 }
 
+// SetUploadAuth enables charm uploads through the /charm-upload
+// endpoint, for requests with HTTP basic authentication credentials
+// accepted by auth. Uploads are disabled by default. Uploaded charms
+// are published by the workers consuming the publish queue of the
+// store, so some QueueWorker must be running. The same credentials
+// may be used to follow the publish jobs at /publish-job/<id>.
+func (s *Server) SetUploadAuth(auth func(user, password string) bool) {
+	s.uploadAuth = auth
+}
+
+// SetAdminAuth enables the administration endpoints under /admin/,
+// along with the publish queue endpoints, for requests with HTTP basic
+// authentication credentials accepted by auth. The endpoints are
+// disabled by default.
+func (s *Server) SetAdminAuth(auth func(user, password string) bool) {
+	s.adminAuth = auth
+}
+
 // ServeHTTP serves an http request.
 // This method turns *Server into an http.Handler.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -122,11 +162,15 @@ func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request) {
 			c.Errors = append(c.Errors, err.Error())
 		}
 		if skey != nil && statsEnabled(r) {
-			go s.store.IncCounter(skey)
+			s.store.IncCounterAsync(skey)
 		}
 	}
 	data, err := json.Marshal(response)
 	if err == nil {
+		w.Header().Set("Cache-Control", cacheRevalidate)
+		if checkNotModified(w, r, weakETag(data), time.Time{}) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(data)
 	}
@@ -144,6 +188,7 @@ func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
 	}
 	r.ParseForm()
 	response := map[string]*charm.EventResponse{}
+	var modtime time.Time
 	for _, url := range r.Form["charms"] {
 		shortURL := url
 		digest := ""
@@ -175,15 +220,25 @@ func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
 			c.Errors = event.Errors
 			c.Warnings = event.Warnings
 			c.Time = event.Time.UTC().Format(time.RFC3339)
+			if event.Time.After(modtime) {
+				modtime = event.Time
+			}
 		} else {
 			c.Errors = append(c.Errors, err.Error())
 		}
 		if skey != nil && statsEnabled(r) {
-			go s.store.IncCounter(skey)
+			s.store.IncCounterAsync(skey)
 		}
 	}
 	data, err := json.Marshal(response)
 	if err == nil {
+		// New events are always more recent than any event
+		// previously served, so the latest one tells whether the
+		// response changed.
+		w.Header().Set("Cache-Control", cacheRevalidate)
+		if checkNotModified(w, r, weakETag(data), modtime) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(data)
 	}
@@ -213,17 +268,594 @@ func (s *Server) serveCharm(w http.ResponseWriter, r *http.Request) {
 		logger.Errorf("cannot open charm %q: %v", curl, err)
 		return
 	}
-	if statsEnabled(r) {
-		go s.store.IncCounter(charmStatsKey(curl, "charm-bundle"))
-	}
 	defer rc.Close()
-	w.Header().Set("Connection", "close") // No keep-alive for now.
+	// Bundles of specific revisions never change, but the latest
+	// revision of a charm may change at any time. It may even become
+	// an older revision, when newer ones are deleted, so its
+	// publishing time isn't a modification time.
+	var modtime time.Time
+	if curl.Revision >= 0 {
+		w.Header().Set("Cache-Control", cacheImmutable)
+		modtime = info.Time()
+	} else {
+		w.Header().Set("Cache-Control", cacheRevalidate)
+	}
+	// The bundle hash identifies the content, so it makes for a strong
+	// entity tag. This is also what If-Range is checked against.
+	if checkNotModified(w, r, `"`+info.BundleSha256()+`"`, modtime) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(info.BundleSize(), 10))
-	_, err = io.Copy(w, rc)
+	cw := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+	if content, ok := rc.(io.ReadSeeker); ok {
+		// ServeContent handles Range and If-Range requests by
+		// seeking in the content, responding with 206 or 416
+		// as appropriate.
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(cw, r, "", time.Time{}, content)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.BundleSize(), 10))
+		if r.Method != "HEAD" {
+			_, err = cw.ReadFrom(rc)
+		}
+	}
 	if err != nil {
 		logger.Errorf("failed to stream charm %q: %v", curl, err)
 	}
+	// Downloads are counted once complete: when the whole bundle is
+	// served, or the rest of it to a download resumed under If-Range.
+	// Other ranges, such as the tail read first by zip readers, aren't
+	// downloads.
+	if cw.servedEnd(info.BundleSize(), isResume(r)) && statsEnabled(r) {
+		s.store.IncCounterAsync(charmStatsKey(curl, "charm-bundle"))
+	}
+}
+
+// Cache-Control header values for responses.
+const (
+	cacheImmutable  = "public, max-age=86400"
+	cacheRevalidate = "public, no-cache"
+)
+
+// weakETag returns a weak entity tag for the response body data.
+func weakETag(data []byte) string {
+	hash := sha256.Sum256(data)
+	return `W/"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// checkNotModified sets the ETag and Last-Modified response headers
+// from etag and modtime, unless they're empty. If the request is
+// conditional and the client already holds the current response, it
+// responds with 304 Not Modified and returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	if etag != "" {
+		w.Header().Set("Etag", etag)
+	}
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored in that case.
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		// The header has a resolution of a second.
+		if err != nil || modtime.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch returns whether etag matches any of the entity tags in the
+// If-None-Match header value inm, using the weak comparison.
+func etagMatch(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter is an http.ResponseWriter that records the status
+// and the number of body bytes of the response written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// servedEnd returns whether the response served the whole of content
+// with the given size, either in full or as the single range of a
+// partial response. If resumed is true, the range may also start past
+// the first byte, as long as it ends with the final one.
+func (w *countingWriter) servedEnd(size int64, resumed bool) bool {
+	switch w.status {
+	case http.StatusOK:
+		return w.written == size
+	case http.StatusPartialContent:
+		var first, last, total int64
+		_, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total)
+		if err != nil || total != size || last != size-1 || w.written != last-first+1 {
+			return false
+		}
+		return first == 0 || resumed
+	}
+	return false
+}
+
+// isResume returns whether r resumes an interrupted download, asking
+// under If-Range for the content from some offset to its end.
+func isResume(r *http.Request) bool {
+	const prefix = "bytes="
+	spec := r.Header.Get("Range")
+	if r.Header.Get("If-Range") == "" || !strings.HasPrefix(spec, prefix) {
+		return false
+	}
+	spec = strings.TrimSpace(spec[len(prefix):])
+	return strings.HasSuffix(spec, "-") && !strings.HasPrefix(spec, "-") && !strings.Contains(spec, ",")
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom. Files are handed over to the
+// underlying writer, which may send them straight from the kernel if
+// it's a network connection, and anything else is copied with a large
+// buffer to keep the number of reads and writes small.
+func (w *countingWriter) ReadFrom(src io.Reader) (n int64, err error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && isFile(src) {
+		n, err = rf.ReadFrom(src)
+		w.written += n
+		return n, err
+	}
+	buf := getStreamBuffer()
+	defer putStreamBuffer(buf)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// isFile returns whether r reads from a file, possibly through an
+// *io.LimitedReader as used by http.ServeContent.
+func isFile(r io.Reader) bool {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	_, ok := r.(*os.File)
+	return ok
+}
+
+// streamBufferSize is the size of the buffers used to stream charm
+// bundles that aren't files.
+const streamBufferSize = 256 << 10
+
+// streamBuffers holds buffers free to be reused for streaming charm
+// bundles, so that they aren't allocated for every download.
+var streamBuffers = make(chan []byte, 64)
+
+func getStreamBuffer() []byte {
+	select {
+	case buf := <-streamBuffers:
+		return buf
+	default:
+		return make([]byte, streamBufferSize)
+	}
+}
+
+func putStreamBuffer(buf []byte) {
+	select {
+	case streamBuffers <- buf:
+	default:
+	}
+}
+
+// MaxUploadSize is the maximum size of an uploaded charm bundle when
+// the bundle policy in effect sets no limit.
+var MaxUploadSize int64 = 100 << 20
+
+// UploadTimeout is how long a charm upload waits for the uploaded
+// charm to be published before responding with its publish job.
+// It is kept short so that uploads don't hold on to their connection
+// while the queue is busy or no worker is running; clients follow
+// the job at /publish-job/<id> instead.
+var UploadTimeout = 5 * time.Second
+
+// UploadResponse holds the result of a charm upload. If the charm
+// wasn't published in time, Job holds the id of the publish job that
+// will publish it.
+type UploadResponse struct {
+	Revision int      `json:"revision"`
+	Job      string   `json:"job,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// serveUpload adds to the publish queue a job for publishing the charm
+// bundle in the request body at the charm URLs in the "url" form
+// values, and responds with the revision assigned to it once the job
+// is finished. If that takes longer than UploadTimeout, it responds
+// with status 202 and the id of the job instead.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/charm-upload" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !authorize(w, r, s.uploadAuth) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var urls []*charm.URL
+	for _, url := range r.URL.Query()["url"] {
+		curl, err := charm.ParseURL(url)
+		if err != nil {
+			writeUpload(w, http.StatusBadRequest, 0, err)
+			return
+		}
+		urls = append(urls, curl)
+	}
+	if len(urls) == 0 {
+		writeUpload(w, http.StatusBadRequest, 0, fmt.Errorf("no charm URLs provided"))
+		return
+	}
+	if err := mustLackRevision("charm upload", urls...); err != nil {
+		writeUpload(w, http.StatusBadRequest, 0, err)
+		return
+	}
+
+	// The bundle is saved to a file, as it must be read as a zip.
+	f, err := ioutil.TempFile("", "charm-upload-")
+	if err != nil {
+		writeUpload(w, http.StatusInternalServerError, 0, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	limit := s.store.bundlePolicy(urls).MaxSize
+	if limit == 0 {
+		limit = MaxUploadSize
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), http.MaxBytesReader(w, r.Body, limit))
+	if err != nil && n >= limit {
+		writeUpload(w, http.StatusRequestEntityTooLarge, 0, fmt.Errorf("charm bundle exceeds %d bytes", limit))
+		return
+	}
+	if err != nil {
+		logger.Errorf("cannot read uploaded charm: %v", err)
+		writeUpload(w, http.StatusBadRequest, 0, err)
+		return
+	}
+	if _, err := charm.ReadBundle(f.Name()); err != nil {
+		writeUpload(w, http.StatusBadRequest, 0, fmt.Errorf("invalid charm bundle: %v", err))
+		return
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if _, err := f.Seek(0, 0); err != nil {
+		writeUpload(w, http.StatusInternalServerError, 0, err)
+		return
+	}
+	job, err := s.store.enqueueUpload(urls, f, digest)
+	if err != nil {
+		logger.Errorf("cannot enqueue uploaded charm at %v: %v", urls, err)
+		writeUpload(w, http.StatusInternalServerError, 0, err)
+		return
+	}
+	stop := make(chan struct{})
+	timer := time.AfterFunc(UploadTimeout, func() { close(stop) })
+	job, err = s.store.waitJob(job.Id, stop)
+	timer.Stop()
+	if err != nil {
+		logger.Errorf("cannot wait for publish job of uploaded charm at %v: %v", urls, err)
+		writeUpload(w, http.StatusInternalServerError, 0, err)
+		return
+	}
+	if job.State != JobDone && job.State != JobFailed {
+		// The client may follow the job at /publish-job/<id>.
+		writeUploadResponse(w, http.StatusAccepted, &UploadResponse{Job: job.Id})
+		return
+	}
+	switch err := job.Err(); err {
+	case nil:
+		writeUpload(w, http.StatusOK, job.Revision, nil)
+	case ErrRedundantUpdate:
+		// The same bundle was uploaded before.
+		infos, err := s.store.getRevisions(urls[0], 1, IncludeDeleted)
+		if err == nil && len(infos) == 0 {
+			err = ErrNotFound
+		}
+		if err != nil {
+			logger.Errorf("cannot find uploaded charm at %v: %v", urls[0], err)
+			writeUpload(w, http.StatusInternalServerError, 0, err)
+			return
+		}
+		if infos[0].Deletion() != nil {
+			err := fmt.Errorf("charm was published as revision %d, which is deleted", infos[0].Revision())
+			writeUpload(w, http.StatusConflict, infos[0].Revision(), err)
+			return
+		}
+		writeUpload(w, http.StatusOK, infos[0].Revision(), nil)
+	default:
+		logger.Errorf("cannot publish uploaded charm at %v: %v", urls, err)
+		writeUpload(w, publishErrorStatus(err), 0, err)
+	}
+}
+
+// statusUnprocessableEntity is the HTTP status code for requests that
+// are well formed but can't be processed, as defined in RFC 4918.
+const statusUnprocessableEntity = 422
+
+// publishErrorStatus returns the HTTP status code for the failure to
+// publish a charm with the given error.
+func publishErrorStatus(err error) int {
+	switch {
+	case isInvalidCharm(err):
+		return statusUnprocessableEntity
+	case IsTransient(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeUpload writes the response to a charm upload.
+func writeUpload(w http.ResponseWriter, code int, revision int, err error) {
+	response := &UploadResponse{Revision: revision}
+	if err != nil {
+		response.Errors = []string{err.Error()}
+	}
+	writeUploadResponse(w, code, response)
+}
+
+// writeUploadResponse writes response to w with the given status code.
+func writeUploadResponse(w http.ResponseWriter, code int, response *UploadResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		logger.Errorf("cannot write content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// authorize checks that r has HTTP basic authentication credentials
+// accepted by auth. If it hasn't, or if auth is nil, an error response
+// is written to w and false is returned.
+func authorize(w http.ResponseWriter, r *http.Request, auth func(user, password string) bool) bool {
+	if auth == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	if user, password, ok := basicAuth(r); !ok || !auth(user, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="charm store"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// basicAuth returns the credentials provided in r with HTTP basic
+// authentication.
+func basicAuth(r *http.Request) (user, password string, ok bool) {
+	const prefix = "Basic "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.Index(string(data), ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return string(data[:i]), string(data[i+1:]), true
+}
+
+// LockResponse describes an update lock held over a charm URL.
+type LockResponse struct {
+	Key      string `json:"key"`
+	Owner    string `json:"owner"`
+	Acquired string `json:"acquired"`
+	Renewed  string `json:"renewed"`
+	Age      string `json:"age"`
+}
+
+// serveLocks responds to GET requests with the update locks currently
+// held, and to DELETE requests by forcefully releasing the lock named
+// by the "key" form value.
+func (s *Server) serveLocks(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/locks" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !authorize(w, r, s.adminAuth) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		locks, err := s.store.Locks()
+		if err != nil {
+			logger.Errorf("cannot list locks: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		response := make([]*LockResponse, len(locks))
+		for i, lock := range locks {
+			response[i] = &LockResponse{
+				Key:      lock.Key,
+				Owner:    lock.Owner,
+				Acquired: lock.Acquired.UTC().Format(time.RFC3339),
+				Renewed:  lock.Time.UTC().Format(time.RFC3339),
+				Age:      now.Sub(lock.Acquired).String(),
+			}
+		}
+		writeJSON(w, response)
+	case "DELETE":
+		key := r.FormValue("key")
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing lock key"))
+			return
+		}
+		switch err := s.store.BreakLock(key); err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			logger.Errorf("cannot break lock %q: %v", key, err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// JobResponse holds the state of a publishing job. Revision holds the
+// revision a done job published the charm at, unless the charm was
+// up-to-date already.
+type JobResponse struct {
+	Id       string   `json:"id"`
+	URLs     []string `json:"urls"`
+	Digest   string   `json:"digest,omitempty"`
+	State    string   `json:"state"`
+	Progress string   `json:"progress,omitempty"`
+	Revision int      `json:"revision"`
+	Error    string   `json:"error,omitempty"`
+	Created  string   `json:"created"`
+	Updated  string   `json:"updated"`
+}
+
+// serveQueue responds with the number of jobs in the publish queue in
+// each state.
+func (s *Server) serveQueue(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/publish-queue" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !authorize(w, r, s.adminAuth) {
+		return
+	}
+	counts, err := s.store.QueueDepth()
+	if err != nil {
+		logger.Errorf("cannot get publish queue depth: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := make(map[string]int)
+	for _, state := range JobStates {
+		response[string(state)] = counts[state]
+	}
+	writeJSON(w, response)
+}
+
+// serveStatsWriter responds with the state of the recording of
+// statistics counters.
+func (s *Server) serveStatsWriter(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/stats/writer" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.store.CounterWriterStats())
+}
+
+// serveJob responds with the state of the publishing job with the id
+// in the request path. Uploaders may follow jobs as well as
+// administrators, since uploads respond with the job publishing the
+// uploaded charm.
+func (s *Server) serveJob(w http.ResponseWriter, r *http.Request) {
+	const dir = "/publish-job/"
+	if !strings.HasPrefix(r.URL.Path, dir) {
+		panic("serveJob: bad url")
+	}
+	var auth func(user, password string) bool
+	if s.adminAuth != nil || s.uploadAuth != nil {
+		auth = func(user, password string) bool {
+			return s.adminAuth != nil && s.adminAuth(user, password) ||
+				s.uploadAuth != nil && s.uploadAuth(user, password)
+		}
+	}
+	if !authorize(w, r, auth) {
+		return
+	}
+	job, err := s.store.PublishJob(r.URL.Path[len(dir):])
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Errorf("cannot get publish job: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := &JobResponse{
+		Id:       job.Id,
+		Digest:   job.Digest,
+		State:    string(job.State),
+		Progress: job.Progress,
+		Revision: job.Revision,
+		Error:    job.Error,
+		Created:  job.Created.UTC().Format(time.RFC3339),
+		Updated:  job.Updated.UTC().Format(time.RFC3339),
+	}
+	for _, url := range job.URLs {
+		response.URLs = append(response.URLs, url.String())
+	}
+	writeJSON(w, response)
+}
+
+// writeJSON writes value to w as a JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logger.Errorf("cannot write content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
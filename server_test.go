@@ -4,13 +4,18 @@
 package store_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	jc "github.com/juju/testing/checkers"
@@ -19,6 +24,7 @@ import (
 
 	"launchpad.net/juju-core/charm"
 	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
 )
 
 func (s *StoreSuite) prepareServer(c *gc.C) (*store.Server, *charm.URL) {
@@ -77,6 +83,147 @@ func (s *StoreSuite) TestServerCharmInfo(c *gc.C) {
 	s.checkCounterSum(c, []string{"charm-missing", "oneiric", "non-existent"}, false, 1)
 }
 
+func (s *StoreSuite) TestServerCharmInfoSoftDeleted(c *gc.C) {
+	server, curl := s.prepareServer(c)
+	_, err := s.store.SoftDeleteCharm(curl, "bob")
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/charm-info?charms="+curl.String(), nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	expected := map[string]interface{}{curl.String(): map[string]interface{}{
+		"revision": float64(0),
+		"errors":   []interface{}{"entry not found"}}}
+	obtained := map[string]interface{}{}
+	err = json.NewDecoder(rec.Body).Decode(&obtained)
+	c.Assert(err, gc.IsNil)
+	c.Assert(obtained, gc.DeepEquals, expected)
+}
+
+func (s *StoreSuite) TestServerUpload(c *gc.C) {
+	s.PatchValue(&store.QueuePollDelay, 10*time.Millisecond)
+	s.PatchValue(&store.JobPollDelay, 10*time.Millisecond)
+	worker := store.NewQueueWorker(s.store, "worker-1")
+	defer worker.Stop()
+	server, err := store.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadFile(testing.Charms.BundlePath(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+	hash := sha256.Sum256(data)
+	digest := hex.EncodeToString(hash[:])
+
+	upload := func(user, password, query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/charm-upload?"+query, bytes.NewReader(data))
+		c.Assert(err, gc.IsNil)
+		req.SetBasicAuth(user, password)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	const query = "url=cs:precise/dummy&url=cs:trusty/dummy"
+
+	// Uploads are disabled by default.
+	rec := upload("admin", "secret", query)
+	c.Assert(rec.Code, gc.Equals, http.StatusForbidden)
+
+	server.SetUploadAuth(func(user, password string) bool {
+		return user == "admin" && password == "secret"
+	})
+	rec = upload("admin", "wrong", query)
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized)
+	c.Assert(rec.Header().Get("WWW-Authenticate"), gc.Not(gc.Equals), "")
+
+	rec = upload("admin", "secret", "url=cs:precise/dummy-1")
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest)
+
+	// Uploading the same bundle twice is harmless.
+	for i := 0; i < 2; i++ {
+		rec = upload("admin", "secret", query)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+		var response store.UploadResponse
+		err = json.NewDecoder(rec.Body).Decode(&response)
+		c.Assert(err, gc.IsNil)
+		c.Assert(response, gc.DeepEquals, store.UploadResponse{Revision: 0})
+	}
+
+	curl := charm.MustParseURL("cs:trusty/dummy")
+	info, err := s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Digest(), gc.Equals, digest)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+	event, err := s.store.CharmEvent(curl, digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+
+	// Uploading a deleted charm again doesn't resurrect it.
+	_, err = s.store.SoftDeleteCharm(curl, "admin")
+	c.Assert(err, gc.IsNil)
+	rec = upload("admin", "secret", query)
+	c.Assert(rec.Code, gc.Equals, http.StatusConflict)
+
+	// Charms that break the bundle policy are rejected, and so are
+	// bundles larger than it allows.
+	s.store.SetBundlePolicy(store.BundlePolicy{MaxFiles: 1})
+	rec = upload("admin", "secret", "url=cs:precise/other")
+	c.Assert(rec.Code, gc.Equals, 422)
+	s.store.SetBundlePolicy(store.BundlePolicy{MaxSize: 16})
+	rec = upload("admin", "secret", "url=cs:precise/another")
+	c.Assert(rec.Code, gc.Equals, http.StatusRequestEntityTooLarge)
+	s.store.SetBundlePolicy(store.BundlePolicy{})
+
+	// Invalid bundles are rejected.
+	data = []byte("not a zip file")
+	rec = upload("admin", "secret", query)
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *StoreSuite) TestServerUploadQueued(c *gc.C) {
+	s.PatchValue(&store.QueuePollDelay, 10*time.Millisecond)
+	s.PatchValue(&store.JobPollDelay, 10*time.Millisecond)
+	s.PatchValue(&store.UploadTimeout, 50*time.Millisecond)
+	server, err := store.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	server.SetUploadAuth(func(user, password string) bool { return true })
+	data, err := ioutil.ReadFile(testing.Charms.BundlePath(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+
+	// With no worker running, the client is told about the job.
+	req, err := http.NewRequest("POST", "/charm-upload?url=cs:precise/dummy", bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusAccepted)
+	var response store.UploadResponse
+	err = json.NewDecoder(rec.Body).Decode(&response)
+	c.Assert(err, gc.IsNil)
+	c.Assert(response.Job, gc.Not(gc.Equals), "")
+
+	// The bundle waiting in the queue isn't taken as an orphan.
+	report, err := s.store.Scrub(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Orphans, gc.HasLen, 0)
+
+	worker := store.NewQueueWorker(s.store, "worker-1")
+	job := s.waitJob(c, response.Job)
+	// Once stopped, the worker is done with the job.
+	worker.Stop()
+	c.Assert(job.State, gc.Equals, store.JobDone)
+	c.Assert(job.Revision, gc.Equals, 0)
+	info, err := s.store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+
+	// The uploaded bundle was removed, leaving the published one.
+	ids, err := store.StoreBackend(s.store).BlobIds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ids, gc.DeepEquals, []store.BlobId{store.CharmInfoBlobId(info)})
+}
+
 func (s *StoreSuite) TestServerCharmEvent(c *gc.C) {
 	server, _ := s.prepareServer(c)
 	req, err := http.NewRequest("GET", "/charm-event", nil)
@@ -237,9 +384,7 @@ func (s *StoreSuite) TestSeriesNotFound(c *gc.C) {
 // checkCounterSum checks that statistics are properly collected.
 // It retries a few times as they are generally collected in background.
 func (s *StoreSuite) checkCounterSum(c *gc.C, key []string, prefix bool, expected int64) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
+	s.store.FlushCounters()
 
 	var sum int64
 	for retry := 0; retry < 10; retry++ {
@@ -268,12 +413,195 @@ func (s *StoreSuite) TestCharmStreaming(c *gc.C) {
 	data, err := ioutil.ReadAll(rec.Body)
 	c.Assert(string(data), gc.Equals, "charm-revision-0")
 
-	c.Assert(rec.Header().Get("Connection"), gc.Equals, "close")
+	c.Assert(rec.Header().Get("Connection"), gc.Equals, "")
 	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/octet-stream")
 	c.Assert(rec.Header().Get("Content-Length"), gc.Equals, "16")
 
 	// Check that it was accounted for in statistics.
 	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 1)
+
+	req, err = http.NewRequest("GET", "/stats/writer", nil)
+	c.Assert(err, gc.IsNil)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var stats store.CounterWriterStats
+	err = json.NewDecoder(rec.Body).Decode(&stats)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats, gc.DeepEquals, store.CounterWriterStats{Recorded: 1})
+}
+
+func (s *StoreSuite) TestCharmStreamingRange(c *gc.C) {
+	server, curl := s.prepareServer(c)
+	info, err := s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+	etag := `"` + info.BundleSha256() + `"`
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/charm/"+curl.String()[3:], nil)
+		c.Assert(err, gc.IsNil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(http.Header{"Range": {"bytes=0-4"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, "charm")
+	c.Assert(rec.Header().Get("Content-Range"), gc.Equals, "bytes 0-4/16")
+	c.Assert(rec.Header().Get("Accept-Ranges"), gc.Equals, "bytes")
+	c.Assert(rec.Header().Get("Etag"), gc.Equals, etag)
+
+	// Partial downloads aren't accounted for in statistics.
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 0)
+
+	// Neither are reads of the end of the bundle, as zip readers do.
+	rec = get(http.Header{"Range": {"bytes=-1"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, "0")
+	c.Assert(rec.Header().Get("Content-Range"), gc.Equals, "bytes 15-15/16")
+	rec = get(http.Header{"Range": {"bytes=10-"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, "sion-0")
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 0)
+
+	// A download may be resumed where it was interrupted, and it's
+	// accounted for once complete.
+	rec = get(http.Header{"Range": {"bytes=5-"}, "If-Range": {etag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, "-revision-0")
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 1)
+
+	// A range covering the whole bundle is a download too.
+	rec = get(http.Header{"Range": {"bytes=0-"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), gc.Equals, "charm-revision-0")
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 2)
+
+	rec = get(http.Header{"Range": {"bytes=0-4,15-"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Matches, "multipart/byteranges; boundary=.*")
+	c.Assert(rec.Body.String(), gc.Matches, "(?s).*Content-Range: bytes 0-4/16\r\n\r\ncharm\r\n.*Content-Range: bytes 15-15/16\r\n\r\n0\r\n.*")
+
+	rec = get(http.Header{"Range": {"bytes=100-200"}})
+	c.Assert(rec.Code, gc.Equals, http.StatusRequestedRangeNotSatisfiable)
+
+	// Neither are multiple ranges nor failed requests.
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 2)
+
+	// If the content changed, the whole of it is sent.
+	rec = get(http.Header{"Range": {"bytes=5-"}, "If-Range": {`"old"`}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Equals, "charm-revision-0")
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 3)
+}
+
+func (s *StoreSuite) TestServerConditionalGet(c *gc.C) {
+	server, curl := s.prepareServer(c)
+	info, err := s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, gc.IsNil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Bundles have a strong entity tag.
+	charmPath := "/charm/" + curl.String()[3:]
+	rec := get(charmPath, nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	etag := rec.Header().Get("Etag")
+	c.Assert(etag, gc.Equals, `"`+info.BundleSha256()+`"`)
+	c.Assert(rec.Header().Get("Cache-Control"), gc.Equals, "public, no-cache")
+
+	rec = get(charmPath, http.Header{"If-None-Match": {etag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+	rec = get(charmPath, http.Header{"If-None-Match": {`"other", ` + etag}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	rec = get(charmPath, http.Header{"If-None-Match": {`"other"`}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+
+	// Bundles of specific revisions may be cached, and have a
+	// modification time.
+	revPath := charmPath + "-0"
+	rec = get(revPath, nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Cache-Control"), gc.Equals, "public, max-age=86400")
+	modified := rec.Header().Get("Last-Modified")
+	c.Assert(modified, gc.Equals, info.Time().UTC().Format(http.TimeFormat))
+	rec = get(revPath, http.Header{"If-Modified-Since": {modified}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	earlier := info.Time().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	rec = get(revPath, http.Header{"If-Modified-Since": {earlier}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+
+	// Unchanged bundles aren't downloaded again.
+	s.checkCounterSum(c, []string{"charm-bundle", curl.Series, curl.Name}, false, 4)
+
+	// The latest revision may go back to an older one, so it has no
+	// modification time.
+	pub, err := s.store.CharmPublisher([]*charm.URL{curl}, "other-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	rec = get(charmPath, nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Last-Modified"), gc.Equals, "")
+	newer := rec.Header().Get("Etag")
+	c.Assert(newer, gc.Not(gc.Equals), etag)
+	_, err = s.store.SoftDeleteCharm(curl.WithRevision(1), "joe")
+	c.Assert(err, gc.IsNil)
+	now := time.Now().UTC().Format(http.TimeFormat)
+	rec = get(charmPath, http.Header{"If-Modified-Since": {now}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Etag"), gc.Equals, etag)
+	rec = get(charmPath, http.Header{"If-None-Match": {newer}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Etag"), gc.Equals, etag)
+
+	// Info and event responses have weak entity tags.
+	for _, path := range []string{"/charm-info", "/charm-event"} {
+		path += "?charms=" + curl.String()
+		rec = get(path, nil)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		etag := rec.Header().Get("Etag")
+		c.Assert(etag, gc.Matches, `W/"[0-9a-f]+"`)
+		c.Assert(rec.Header().Get("Cache-Control"), gc.Equals, "public, no-cache")
+		rec = get(path, http.Header{"If-None-Match": {etag}})
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+		rec = get(path+"&charms=cs:precise/other", http.Header{"If-None-Match": {etag}})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+
+	// Events are newer than any previous response.
+	event := &store.CharmEvent{
+		Kind:   store.EventPublished,
+		Digest: "some-digest",
+		URLs:   []*charm.URL{curl},
+		Time:   time.Unix(1e9, 0),
+	}
+	err = s.store.LogCharmEvent(event)
+	c.Assert(err, gc.IsNil)
+	eventPath := "/charm-event?charms=" + curl.String()
+	rec = get(eventPath, nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	modified = rec.Header().Get("Last-Modified")
+	c.Assert(modified, gc.Equals, event.Time.UTC().Format(http.TimeFormat))
+	rec = get(eventPath, http.Header{"If-Modified-Since": {modified}})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+
+	event.Digest = "other-digest"
+	event.Time = event.Time.Add(time.Second)
+	err = s.store.LogCharmEvent(event)
+	c.Assert(err, gc.IsNil)
+	rec = get(eventPath, http.Header{"If-Modified-Since": {modified}})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
 }
 
 func (s *StoreSuite) TestDisableStats(c *gc.C) {
@@ -336,10 +664,6 @@ func (s *StoreSuite) TestRootRedirect(c *gc.C) {
 }
 
 func (s *StoreSuite) TestStatsCounter(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
 	for _, key := range [][]string{{"a", "b"}, {"a", "b"}, {"a", "c"}, {"a"}} {
 		err := s.store.IncCounter(key)
 		c.Assert(err, gc.IsNil)
@@ -370,10 +694,6 @@ func (s *StoreSuite) TestStatsCounter(c *gc.C) {
 }
 
 func (s *StoreSuite) TestStatsCounterList(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
 	incs := [][]string{
 		{"a"},
 		{"a", "b"},
@@ -421,11 +741,7 @@ func (s *StoreSuite) TestStatsCounterList(c *gc.C) {
 	}
 }
 
-func (s *StoreSuite) TestStatsCounterBy(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
+func (s *MgoStoreSuite) TestStatsCounterBy(c *gc.C) {
 	incs := []struct {
 		key []string
 		day int
@@ -637,3 +953,116 @@ func (s *StoreSuite) TestBlitzKey(c *gc.C) {
 	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/plain")
 	c.Assert(rec.Header().Get("Content-Length"), gc.Equals, "2")
 }
+
+func (s *StoreSuite) TestServerLocks(c *gc.C) {
+	server, err := store.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	lock, err := s.store.LockUpdates(urls[:1])
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		c.Assert(err, gc.IsNil)
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The endpoints are disabled by default.
+	rec := do("GET", "/admin/locks")
+	c.Assert(rec.Code, gc.Equals, http.StatusForbidden)
+
+	server.SetAdminAuth(func(user, password string) bool {
+		return user == "admin" && password == "secret"
+	})
+	rec = do("GET", "/admin/locks")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var locks []store.LockResponse
+	err = json.NewDecoder(rec.Body).Decode(&locks)
+	c.Assert(err, gc.IsNil)
+	c.Assert(locks, gc.HasLen, 1)
+	c.Assert(locks[0].Key, gc.Equals, urls[0].String())
+	c.Assert(locks[0].Owner, gc.Equals, store.LockOwner)
+	_, err = time.ParseDuration(locks[0].Age)
+	c.Assert(err, gc.IsNil)
+
+	rec = do("DELETE", "/admin/locks?key="+url.QueryEscape(urls[0].String()))
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	rec = do("DELETE", "/admin/locks?key="+url.QueryEscape(urls[0].String()))
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+	rec = do("DELETE", "/admin/locks")
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest)
+	rec = do("POST", "/admin/locks")
+	c.Assert(rec.Code, gc.Equals, http.StatusMethodNotAllowed)
+
+	remaining, err := s.store.Locks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(remaining, gc.HasLen, 0)
+}
+
+// bigCharmDir is a FakeCharmDir with a bundle of the given size.
+type bigCharmDir struct {
+	FakeCharmDir
+	size int
+}
+
+func (d *bigCharmDir) BundleTo(w io.Writer) error {
+	_, err := w.Write(bytes.Repeat([]byte{'x'}, d.size))
+	return err
+}
+
+// benchmarkDownloads measures the throughput of the given number of
+// clients concurrently downloading a charm bundle of the given size
+// over keep-alive connections, for c.N downloads in total.
+func (s *StoreSuite) benchmarkDownloads(c *gc.C, clients, size int) {
+	curl := charm.MustParseURL("cs:precise/wordpress")
+	pub, err := s.store.CharmPublisher([]*charm.URL{curl}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&bigCharmDir{size: size})
+	c.Assert(err, gc.IsNil)
+	server, err := store.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: clients}}
+	downloads := make(chan struct{}, c.N)
+	for i := 0; i < c.N; i++ {
+		downloads <- struct{}{}
+	}
+	close(downloads)
+	c.SetBytes(int64(size))
+	c.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _ = range downloads {
+				resp, err := client.Get(httpServer.URL + "/charm/precise/wordpress?stats=0")
+				if !c.Check(err, gc.IsNil) {
+					return
+				}
+				n, err := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				c.Check(err, gc.IsNil)
+				c.Check(n, gc.Equals, int64(size))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *StoreSuite) BenchmarkDownloads1(c *gc.C) {
+	s.benchmarkDownloads(c, 1, 1<<20)
+}
+
+func (s *StoreSuite) BenchmarkDownloads10(c *gc.C) {
+	s.benchmarkDownloads(c, 10, 1<<20)
+}
+
+func (s *StoreSuite) BenchmarkDownloads100(c *gc.C) {
+	s.benchmarkDownloads(c, 100, 1<<20)
+}
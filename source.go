@@ -0,0 +1,397 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"launchpad.net/juju-core/charm"
+)
+
+// DirSource is a Source that retrieves charms from the local directory
+// at the given path. The digest is the SHA256 hash of the directory
+// content, as computed by dirDigest.
+type DirSource string
+
+// Checkout implements Source.Checkout.
+func (src DirSource) Checkout(dir string) (digest string, err error) {
+	if err := copyDir(dir, string(src)); err != nil {
+		return "", err
+	}
+	return dirDigest(dir)
+}
+
+// vcsDirs holds the names of version control metadata directories,
+// which are ignored when reading charms from local directories.
+var vcsDirs = map[string]bool{
+	".bzr": true,
+	".git": true,
+	".hg":  true,
+}
+
+// copyDir copies the content of the directory at src into the new
+// directory dst, leaving out version control metadata.
+func copyDir(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		mode := info.Mode()
+		switch {
+		case mode.IsDir() && vcsDirs[info.Name()]:
+			return filepath.SkipDir
+		case mode.IsDir():
+			if err := os.Mkdir(target, mode.Perm()); err != nil {
+				return err
+			}
+			// Keep the content digest unaffected by the umask.
+			return os.Chmod(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(target, path, mode.Perm())
+		}
+		return invalidCharm(fmt.Errorf("cannot copy %s: unsupported file type", path))
+	})
+}
+
+// copyFile copies the regular file at src into the new file dst.
+func copyFile(dst, src string, perm os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
+
+// dirDigest returns the hex-encoded SHA256 hash of the content of the
+// directory at dir, which covers the path, type, permissions and data
+// of each of the files within, and ignores version control metadata.
+func dirDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		if mode.IsDir() && vcsDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", filepath.ToSlash(rel), mode)
+		switch {
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", link)
+		case mode.IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\x00", info.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ArchiveSource is a Source that retrieves charms from the bundle file
+// at the given path. The digest is the SHA256 hash of the file.
+type ArchiveSource string
+
+// Checkout implements Source.Checkout.
+func (src ArchiveSource) Checkout(dir string) (digest string, err error) {
+	digest, err = fileDigest(string(src))
+	if err != nil {
+		return "", err
+	}
+	bundle, err := charm.ReadBundle(string(src))
+	if err != nil {
+		return "", invalidCharm(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := bundle.ExpandTo(dir); err != nil {
+		return "", invalidCharm(err)
+	}
+	return digest, nil
+}
+
+// fileDigest returns the hex-encoded SHA256 hash of the content of the
+// file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TarballSource is a Source that retrieves charms from the tar archive
+// at the given HTTP URL, which may be compressed with gzip or bzip2.
+// If all the archive entries are inside a single top-level directory,
+// that directory holds the charm. The digest is the SHA256 hash of the
+// archive.
+type TarballSource string
+
+// TarballTimeout is how long retrieving the archive of a TarballSource
+// may take before it's given up on.
+var TarballTimeout = 10 * time.Minute
+
+// Checkout implements Source.Checkout.
+func (src TarballSource) Checkout(dir string) (digest string, err error) {
+	return src.CheckoutAbort(dir, nil)
+}
+
+// CheckoutAbort implements AbortableSource.CheckoutAbort.
+func (src TarballSource) CheckoutAbort(dir string, abort <-chan struct{}) (digest string, err error) {
+	req, err := http.NewRequest("GET", string(src), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Cancel = abort
+	client := &http.Client{Timeout: TarballTimeout}
+	resp, err := client.Do(req)
+	if isClosed(abort) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return "", ErrAborted
+	}
+	if err != nil {
+		return "", transient(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("cannot get %s: %s", src, resp.Status)
+		if resp.StatusCode >= 500 {
+			// The server may recover.
+			return "", transient(err)
+		}
+		return "", err
+	}
+
+	// The archive is read twice, so it's saved to a file first.
+	f, err := ioutil.TempFile("", "publish-tarball-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		if isClosed(abort) {
+			return "", ErrAborted
+		}
+		return "", transient(fmt.Errorf("cannot get %s: %v", src, err))
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+
+	// Find the top-level directory holding all the entries, if any.
+	var top string
+	single := true
+	err = readTarball(f, func(hdr *tar.Header, r io.Reader) error {
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			return nil
+		}
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) == 1 && hdr.Typeflag != tar.TypeDir || top != "" && parts[0] != top {
+			single = false
+		}
+		top = parts[0]
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !single || top == ".." {
+		top = ""
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	err = readTarball(f, func(hdr *tar.Header, r io.Reader) error {
+		return extractEntry(dir, top, hdr, r)
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// isClosed reports whether the channel c is closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// readTarball calls f for each of the entries in the tar archive
+// held by file, which may be compressed.
+func readTarball(file *os.File, f func(hdr *tar.Header, r io.Reader) error) error {
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(3)
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return invalidCharm(fmt.Errorf("invalid charm archive: %v", err))
+		}
+		defer gr.Close()
+		r = gr
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidCharm(fmt.Errorf("invalid charm archive: %v", err))
+		}
+		if err := f(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry extracts the tar entry described by hdr, with content
+// read from r, into dir. If top is not empty, the entry must be inside
+// the top directory, and is extracted relative to it.
+func extractEntry(dir, top string, hdr *tar.Header, r io.Reader) error {
+	name := path.Clean(hdr.Name)
+	if top != "" {
+		if name == top {
+			return nil
+		}
+		name = strings.TrimPrefix(name, top+"/")
+	}
+	if name == "." {
+		return nil
+	}
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return invalidCharm(fmt.Errorf("invalid charm archive: bad entry name %q", hdr.Name))
+	}
+	// Entries must not be written through links extracted before,
+	// even if each of the links is harmless by itself.
+	if err := checkNoLinks(dir, name); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	perm := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, perm)
+	case tar.TypeSymlink:
+		// Links must not allow entries to be written elsewhere.
+		link := path.Join(path.Dir(name), hdr.Linkname)
+		if path.IsAbs(hdr.Linkname) || link == ".." || strings.HasPrefix(link, "../") {
+			return invalidCharm(fmt.Errorf("invalid charm archive: bad link target %q", hdr.Linkname))
+		}
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeReg, tar.TypeRegA:
+		w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	// Other entry types have no place in a charm.
+	logger.Warningf("ignoring archive entry %q with type %q", hdr.Name, hdr.Typeflag)
+	return nil
+}
+
+// checkNoLinks returns an error if any of the existing parent
+// directories of the slash-separated path name, relative to dir, is a
+// symbolic link.
+func checkNoLinks(dir, name string) error {
+	parts := strings.Split(name, "/")
+	p := dir
+	for _, part := range parts[:len(parts)-1] {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return invalidCharm(fmt.Errorf("invalid charm archive: entry %q is inside a link", name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	gc "launchpad.net/gocheck"
+
+	"launchpad.net/juju-core/store"
+	"launchpad.net/juju-core/testing"
+)
+
+func (s *StoreSuite) TestPublishDirSource(c *gc.C) {
+	dir := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	src := store.DirSource(dir)
+
+	err := store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+	digest1 := info.Digest()
+
+	// Version control metadata doesn't change the digest.
+	err = os.Mkdir(filepath.Join(dir, ".git"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+
+	// Changing the content does.
+	err = ioutil.WriteFile(filepath.Join(dir, "timestamp"), []byte("now"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = store.Publish(s.store, urls, src, digest1)
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+	err = store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 1)
+	c.Assert(info.Digest(), gc.Not(gc.Equals), digest1)
+
+	event, err := s.store.CharmEvent(urls[0], info.Digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+	c.Assert(event.Revision, gc.Equals, 1)
+}
+
+func (s *StoreSuite) TestDryRun(c *gc.C) {
+	dir := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	src := store.DirSource(dir)
+
+	result, err := store.DryRun(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.URLs, gc.DeepEquals, urls)
+	c.Assert(result.Revision, gc.Equals, 0)
+	c.Assert(result.Digest, gc.Not(gc.Equals), "wrong-rev")
+	c.Assert(result.Sha256, gc.HasLen, 64)
+
+	// Nothing was written to the store.
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	_, err = s.store.CharmEvent(urls[0], result.Digest)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report, gc.DeepEquals, &store.ScrubReport{})
+
+	// Publishing for real gives the same outcome.
+	err = store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, result.Revision)
+	c.Assert(info.Digest(), gc.Equals, result.Digest)
+	c.Assert(info.BundleSha256(), gc.Equals, result.Sha256)
+	c.Assert(info.BundleSize(), gc.Equals, result.Size)
+
+	_, err = store.DryRun(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+
+	// The next revision is reported once the content changes.
+	err = ioutil.WriteFile(filepath.Join(dir, "timestamp"), []byte("now"), 0644)
+	c.Assert(err, gc.IsNil)
+	result, err = store.DryRun(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Revision, gc.Equals, 1)
+	c.Assert(result.Sha256, gc.Not(gc.Equals), info.BundleSha256())
+	info, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestPublishTarballSource(c *gc.C) {
+	dir := testing.Charms.ClonedDirPath(c.MkDir(), "dummy")
+	data := tarball(c, dir, "dummy-1.0/")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	err := store.Publish(s.store, urls, store.TarballSource(server.URL), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+	hash := sha256.Sum256(data)
+	c.Assert(info.Digest(), gc.Equals, hex.EncodeToString(hash[:]))
+}
+
+func (s *StoreSuite) TestPublishTarballSourceError(c *gc.C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: "hooks", Typeflag: tar.TypeSymlink, Linkname: "../.."})
+	c.Assert(err, gc.IsNil)
+	c.Assert(tw.Close(), gc.IsNil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	err = store.Publish(s.store, urls, store.TarballSource(server.URL), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, `invalid charm archive: bad link target "../.."`)
+	c.Assert(store.IsTransient(err), gc.Equals, false)
+
+	// Errors in the archive aren't retried, and are logged.
+	event, err := s.store.CharmEvent(urls[0], "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, false)
+	c.Assert(event.Attempts, gc.HasLen, 1)
+
+	err = store.Publish(s.store, urls, store.TarballSource(server.URL+"/missing"), "other-rev")
+	c.Assert(err, gc.ErrorMatches, "cannot get .*/missing: 404 Not Found")
+	c.Assert(store.IsTransient(err), gc.Equals, false)
+}
+
+func (s *StoreSuite) TestPublishTarballSourceUnavailable(c *gc.C) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := store.Publish(s.store, urls, store.TarballSource(server.URL), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, "cannot get .*: 503 Service Unavailable")
+	c.Assert(store.IsTransient(err), gc.Equals, true)
+	c.Assert(calls, gc.Equals, 3)
+
+	event, err := s.store.CharmEvent(urls[0], "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Transient, gc.Equals, true)
+	c.Assert(event.Attempts, gc.HasLen, 3)
+}
+
+func (s *StoreSuite) TestTarballSourceStalled(c *gc.C) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// Retrieval is interrupted when aborted.
+	abort := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(abort) })
+	_, err := store.TarballSource(server.URL).CheckoutAbort(filepath.Join(c.MkDir(), "charm"), abort)
+	c.Assert(err, gc.Equals, store.ErrAborted)
+
+	// It's also given up on when it takes too long, but the server
+	// may recover.
+	s.PatchValue(&store.TarballTimeout, 50*time.Millisecond)
+	_, err = store.TarballSource(server.URL).Checkout(filepath.Join(c.MkDir(), "charm"))
+	c.Assert(err, gc.ErrorMatches, "cannot get .*")
+	c.Assert(store.IsTransient(err), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestTarballSourceChainedLinks(c *gc.C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "sub", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "sub/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "sub/l/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	} {
+		err := tw.WriteHeader(hdr)
+		c.Assert(err, gc.IsNil)
+		if hdr.Size > 0 {
+			_, err = tw.Write([]byte("evil"))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+	c.Assert(tw.Close(), gc.IsNil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	// Nothing is written outside the checkout directory.
+	base := c.MkDir()
+	_, err := store.TarballSource(server.URL).Checkout(filepath.Join(base, "charm"))
+	c.Assert(err, gc.ErrorMatches, `invalid charm archive: entry "sub/l" is inside a link`)
+	_, err = os.Lstat(filepath.Join(base, "x"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishDir(c *gc.C) {
+	dir := testing.Charms.ClonedDir(c.MkDir(), "dummy")
+	err := store.PublishDir(s.store, urls, dir)
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+
+	// The digest comes from the content, so it's known without
+	// retrieving the charm again.
+	event, err := s.store.CharmEvent(urls[1], info.Digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+	err = store.PublishDir(s.store, urls, dir)
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+}
+
+func (s *StoreSuite) TestPublishArchive(c *gc.C) {
+	path := testing.Charms.BundlePath(c.MkDir(), "dummy")
+	err := store.PublishArchive(s.store, urls, path)
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Meta().Name, gc.Equals, "dummy")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	hash := sha256.Sum256(data)
+	c.Assert(info.Digest(), gc.Equals, hex.EncodeToString(hash[:]))
+
+	err = store.PublishArchive(s.store, urls, path)
+	c.Assert(err, gc.Equals, store.ErrRedundantUpdate)
+
+	err = store.PublishArchive(s.store, urls, filepath.Join(c.MkDir(), "missing"))
+	c.Assert(err, gc.ErrorMatches, ".*no such file or directory")
+}
+
+// flakySource is a Source that fails to retrieve the charm until it
+// has been asked to do so fails+1 times.
+type flakySource struct {
+	dir   string
+	fails int
+	calls int
+}
+
+func (src *flakySource) Checkout(dir string) (digest string, err error) {
+	src.calls++
+	if src.calls <= src.fails {
+		return "", store.Transient(fmt.Errorf("flaky failure %d", src.calls))
+	}
+	return store.DirSource(src.dir).Checkout(dir)
+}
+
+func (s *StoreSuite) TestPublishRetry(c *gc.C) {
+	src := &flakySource{dir: testing.Charms.ClonedDirPath(c.MkDir(), "dummy"), fails: 2}
+	err := store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(src.calls, gc.Equals, 3)
+
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	event, err := s.store.CharmEvent(urls[0], info.Digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublished)
+	c.Assert(event.Transient, gc.Equals, false)
+	c.Assert(event.Attempts, gc.HasLen, 3)
+	c.Assert(event.Attempts[0].Error, gc.Equals, "flaky failure 1")
+	c.Assert(event.Attempts[1].Error, gc.Equals, "flaky failure 2")
+	c.Assert(event.Attempts[2].Error, gc.Equals, "")
+}
+
+func (s *StoreSuite) TestPublishRetryExhausted(c *gc.C) {
+	src := &flakySource{dir: testing.Charms.ClonedDirPath(c.MkDir(), "dummy"), fails: 3}
+	err := store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, "flaky failure 3")
+	c.Assert(store.IsTransient(err), gc.Equals, true)
+	c.Assert(src.calls, gc.Equals, 3)
+
+	event, err := s.store.CharmEvent(urls[0], "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, store.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, true)
+	c.Assert(event.Errors, gc.DeepEquals, []string{"flaky failure 3"})
+	c.Assert(event.Attempts, gc.HasLen, 3)
+
+	// Transient failures don't prevent publishing from being
+	// attempted again.
+	err = store.Publish(s.store, urls, src, "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(src.calls, gc.Equals, 4)
+}
+
+func (s *TrivialSuite) TestRetryDelay(c *gc.C) {
+	strategy := store.RetryStrategy{Attempts: 10, Delay: time.Second, MaxDelay: 5 * time.Second}
+	for retry, delay := range []time.Duration{1, 1, 2, 4, 5, 5, 5} {
+		c.Check(store.RetryDelay(strategy, retry), gc.Equals, delay*time.Second)
+	}
+}
+
+// tarball returns a gzipped tar archive with the content of dir,
+// with entry names prefixed by prefix.
+func tarball(c *gc.C, dir, prefix string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    prefix + filepath.ToSlash(rel),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case info.Mode()&os.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		}
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(tw.Close(), gc.IsNil)
+	c.Assert(gw.Close(), gc.IsNil)
+	return buf.Bytes()
+}
@@ -0,0 +1,225 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsFlushInterval is how often the counter increments made with
+// IncCounterAsync are recorded in the database.
+var StatsFlushInterval = 10 * time.Second
+
+// StatsFlushSize is the number of distinct counters with pending
+// increments that causes them to be recorded before StatsFlushInterval
+// elapses.
+var StatsFlushSize = 500
+
+// StatsMaxPending is the maximum number of distinct counters with
+// pending increments. While recording them lags behind, increments of
+// further counters are dropped, and reported in CounterWriterStats.
+var StatsMaxPending = 10000
+
+// CounterInc is an increment of a statistics counter.
+type CounterInc struct {
+	Key []string
+
+	// Time holds the time of the increment, rounded to the start of
+	// a minute.
+	Time  time.Time
+	Count int64
+}
+
+// counterTime returns t rounded to the start of its minute, which is
+// the resolution of counters.
+func counterTime(t time.Time) time.Time {
+	t = t.UTC()
+	return t.Add(-time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+// CounterWriterStats reports on the recording of the counter increments
+// made with IncCounterAsync.
+type CounterWriterStats struct {
+	// Pending holds the number of distinct counters with increments
+	// waiting to be recorded.
+	Pending int `json:"pending"`
+
+	// Recorded holds the number of increments recorded.
+	Recorded int64 `json:"recorded"`
+
+	// Dropped holds the number of increments dropped because too
+	// many counters were pending.
+	Dropped int64 `json:"dropped"`
+
+	// Failed holds the number of increments lost to database errors.
+	Failed int64 `json:"failed"`
+}
+
+// IncCounterAsync is like IncCounter, but records the increment in the
+// background, so that the caller doesn't wait on the database.
+// Increments of the same counter within the same minute are merged,
+// and recorded together with all the other pending increments every
+// StatsFlushInterval, or as soon as StatsFlushSize counters are
+// pending. Pending increments are also recorded when the store is
+// closed.
+func (s *Store) IncCounterAsync(key []string) {
+	if len(key) == 0 {
+		logger.Errorf("store: empty statistics key")
+		return
+	}
+	s.stats.once.Do(func() {
+		s.stats.start(s.backend)
+	})
+	s.stats.inc(key, counterTime(time.Now()))
+}
+
+// FlushCounters records the pending increments made with
+// IncCounterAsync right away.
+func (s *Store) FlushCounters() {
+	s.stats.flushPending()
+}
+
+// CounterWriterStats reports on the recording of the increments made
+// with IncCounterAsync.
+func (s *Store) CounterWriterStats() CounterWriterStats {
+	w := &s.stats
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return CounterWriterStats{
+		Pending:  len(w.pending),
+		Recorded: w.recorded,
+		Dropped:  w.dropped,
+		Failed:   w.failed,
+	}
+}
+
+// counterKey identifies a counter within a minute.
+type counterKey struct {
+	key   string
+	stamp int32
+}
+
+// counterWriter merges counter increments and records them in bulk in
+// the background.
+type counterWriter struct {
+	once    sync.Once
+	backend Backend
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	// flushing serializes the recording of increments.
+	flushing sync.Mutex
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	pending  map[counterKey]*CounterInc
+	recorded int64
+	dropped  int64
+	failed   int64
+	reported int64
+}
+
+// start starts recording increments into backend.
+func (w *counterWriter) start(backend Backend) {
+	w.backend = backend
+	w.pending = make(map[counterKey]*CounterInc)
+	w.flush = make(chan struct{}, 1)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.loop()
+}
+
+// close records the pending increments and stops the writer.
+func (w *counterWriter) close() {
+	// Prevent the writer from being started afterwards.
+	w.once.Do(func() {})
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+}
+
+// inc adds an increment of the counter for key at time t, which must be
+// rounded to the start of a minute.
+func (w *counterWriter) inc(key []string, t time.Time) {
+	ckey := counterKey{strings.Join(key, "\x00"), timeToStamp(t)}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		// The writer was closed.
+		w.dropped++
+		return
+	}
+	if inc, ok := w.pending[ckey]; ok {
+		inc.Count++
+		return
+	}
+	if len(w.pending) >= StatsMaxPending {
+		w.dropped++
+		return
+	}
+	w.pending[ckey] = &CounterInc{Key: key, Time: t, Count: 1}
+	if len(w.pending) >= StatsFlushSize {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *counterWriter) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(StatsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.stop:
+			w.flushPending()
+			w.mu.Lock()
+			w.pending = nil
+			w.mu.Unlock()
+			return
+		}
+		w.flushPending()
+	}
+}
+
+// flushPending records all the pending increments.
+func (w *counterWriter) flushPending() {
+	w.flushing.Lock()
+	defer w.flushing.Unlock()
+	w.mu.Lock()
+	if len(w.pending) == 0 {
+		w.mu.Unlock()
+		return
+	}
+	incs := make([]CounterInc, 0, len(w.pending))
+	var count int64
+	for ckey, inc := range w.pending {
+		incs = append(incs, *inc)
+		count += inc.Count
+		delete(w.pending, ckey)
+	}
+	if dropped := w.dropped - w.reported; dropped > 0 {
+		logger.Warningf("dropped %d counter increments while recording lagged behind", dropped)
+		w.reported = w.dropped
+	}
+	w.mu.Unlock()
+
+	err := w.backend.IncCounters(incs)
+	w.mu.Lock()
+	if err != nil {
+		logger.Errorf("cannot record %d counter increments: %v", count, err)
+		w.failed += count
+	} else {
+		w.recorded += count
+	}
+	w.mu.Unlock()
+}
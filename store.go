@@ -2,8 +2,9 @@
 // Licensed under the AGPLv3, see LICENCE file for details.
 
 // The store package is capable of storing and updating charms in a MongoDB
-// database, as well as maintaining further information about them such as
-// the VCS revision the charm was loaded from and the URLs for the charms.
+// database or any other storage Backend, as well as maintaining further
+// information about them such as the VCS revision the charm was loaded
+// from and the URLs for the charms.
 package store
 
 import (
@@ -13,14 +14,12 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"os"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/loggo"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 
 	"launchpad.net/juju-core/charm"
@@ -28,15 +27,6 @@ import (
 
 var logger = loggo.GetLogger("juju.store")
 
-// The following MongoDB collections are currently used:
-//
-//     juju.events        - Log of events relating to the lifecycle of charms
-//     juju.charms        - Information about the stored charms
-//     juju.charmfs.*     - GridFS with the charm files
-//     juju.locks         - Has unique keys with url of updating charms
-//     juju.stat.counters - Counters for statistics
-//     juju.stat.tokens   - Tokens used in statistics counter keys
-
 var (
 	ErrUpdateConflict  = errors.New("charm update in progress")
 	ErrRedundantUpdate = errors.New("charm is up-to-date")
@@ -53,14 +43,24 @@ const (
 
 // Store holds a connection to a charm store.
 type Store struct {
-	session *storeSession
+	backend Backend
+
+	// fatalLint holds the lint checks that prevent charms from being
+	// published.
+	fatalLint map[string]bool
+
+	// policy holds the policy charm bundles must comply with, and
+	// userPolicies the policies replacing it for specific users.
+	policy       BundlePolicy
+	userPolicies map[string]BundlePolicy
+
+	// stats records the increments made with IncCounterAsync.
+	stats counterWriter
 
-	// Cache for statistics key words (two generations).
-	cacheMu       sync.RWMutex
-	statsIdNew    map[string]int
-	statsIdOld    map[string]int
-	statsTokenNew map[int]string
-	statsTokenOld map[int]string
+	// purgeStop and purgeDone control the purging started by
+	// StartPurging.
+	purgeStop chan struct{}
+	purgeDone chan struct{}
 }
 
 // Open creates a new session with the store. It connects to the MongoDB
@@ -68,170 +68,34 @@ type Store struct {
 // labix.org/v2/mgo package).
 func Open(mongoAddr string) (store *Store, err error) {
 	logger.Infof("store opened, connecting to: %s", mongoAddr)
-	store = &Store{}
-	session, err := mgo.Dial(mongoAddr)
+	backend, err := NewMongoBackend(mongoAddr)
 	if err != nil {
-		logger.Errorf("error connecting to MongoDB: %v", err)
 		return nil, err
 	}
-
-	store = &Store{session: &storeSession{session}}
-
-	// Ignore error. It'll always fail after created.
-	// TODO Check the error once mgo hands it to us.
-	_ = store.session.DB("juju").Run(bson.D{{"create", "stat.counters"}, {"autoIndexId", false}}, nil)
-
-	if err := store.ensureIndexes(); err != nil {
-		session.Close()
+	store, err = New(backend)
+	if err != nil {
+		backend.Close()
 		return nil, err
 	}
-
-	// Put the used socket back in the pool.
-	session.Refresh()
 	return store, nil
 }
 
-func (s *Store) ensureIndexes() error {
-	session := s.session
-	indexes := []struct {
-		c *mgo.Collection
-		i mgo.Index
-	}{{
-		session.StatCounters(),
-		mgo.Index{Key: []string{"k", "t"}, Unique: true},
-	}, {
-		session.StatTokens(),
-		mgo.Index{Key: []string{"t"}, Unique: true},
-	}, {
-		session.Charms(),
-		mgo.Index{Key: []string{"urls", "revision"}, Unique: true},
-	}, {
-		session.Events(),
-		mgo.Index{Key: []string{"urls", "digest"}},
-	}}
-	for _, idx := range indexes {
-		err := idx.c.EnsureIndex(idx.i)
-		if err != nil {
-			logger.Errorf("error ensuring stat.counters index: %v", err)
-			return err
-		}
+// New returns a new *Store that keeps its data in backend.
+// The backend is closed when the store is closed.
+// Any charm deletion left unfinished in backend is finished.
+func New(backend Backend) (*Store, error) {
+	s := &Store{backend: backend}
+	if err := s.recoverDeletes(); err != nil {
+		return nil, err
 	}
-	return nil
+	return s, nil
 }
 
 // Close terminates the connection with the store.
 func (s *Store) Close() {
-	s.session.Close()
-}
-
-// statsKey returns the compound statistics identifier that represents key.
-// If write is true, the identifier will be created if necessary.
-// Identifiers have a form similar to "ab:c:def:", where each section is a
-// base-32 number that represents the respective word in key. This form
-// allows efficiently indexing and searching for prefixes, while detaching
-// the key content and size from the actual words used in key.
-func (s *Store) statsKey(session *storeSession, key []string, write bool) (string, error) {
-	if len(key) == 0 {
-		return "", fmt.Errorf("store: empty statistics key")
-	}
-	tokens := session.StatTokens()
-	skey := make([]byte, 0, len(key)*4)
-	// Retry limit is mainly to prevent infinite recursion in edge cases,
-	// such as if the database is ever run in read-only mode.
-	// The logic below should deteministically stop in normal scenarios.
-	var err error
-	for i, retry := 0, 30; i < len(key) && retry > 0; retry-- {
-		err = nil
-		id, found := s.statsTokenId(key[i])
-		if !found {
-			var t tokenId
-			err = tokens.Find(bson.D{{"t", key[i]}}).One(&t)
-			if err == mgo.ErrNotFound {
-				if !write {
-					return "", ErrNotFound
-				}
-				t.Id, err = tokens.Count()
-				if err != nil {
-					continue
-				}
-				t.Id++
-				t.Token = key[i]
-				err = tokens.Insert(&t)
-			}
-			if err != nil {
-				continue
-			}
-			s.cacheStatsTokenId(t.Token, t.Id)
-			id = t.Id
-		}
-		skey = strconv.AppendInt(skey, int64(id), 32)
-		skey = append(skey, ':')
-		i++
-	}
-	if err != nil {
-		return "", err
-	}
-	return string(skey), nil
-}
-
-const statsTokenCacheSize = 1024
-
-type tokenId struct {
-	Id    int    `bson:"_id"`
-	Token string `bson:"t"`
-}
-
-// cacheStatsTokenId adds the id for token into the cache.
-// The cache has two generations so that the least frequently used
-// tokens are evicted regularly.
-func (s *Store) cacheStatsTokenId(token string, id int) {
-	s.cacheMu.Lock()
-	defer s.cacheMu.Unlock()
-	// Can't possibly be >, but reviews want it for defensiveness.
-	if len(s.statsIdNew) >= statsTokenCacheSize {
-		s.statsIdOld = s.statsIdNew
-		s.statsIdNew = nil
-		s.statsTokenOld = s.statsTokenNew
-		s.statsTokenNew = nil
-	}
-	if s.statsIdNew == nil {
-		s.statsIdNew = make(map[string]int, statsTokenCacheSize)
-		s.statsTokenNew = make(map[int]string, statsTokenCacheSize)
-	}
-	s.statsIdNew[token] = id
-	s.statsTokenNew[id] = token
-}
-
-// statsTokenId returns the id for token from the cache, if found.
-func (s *Store) statsTokenId(token string) (id int, found bool) {
-	s.cacheMu.RLock()
-	id, found = s.statsIdNew[token]
-	if found {
-		s.cacheMu.RUnlock()
-		return
-	}
-	id, found = s.statsIdOld[token]
-	s.cacheMu.RUnlock()
-	if found {
-		s.cacheStatsTokenId(token, id)
-	}
-	return
-}
-
-// statsIdToken returns the token for id from the cache, if found.
-func (s *Store) statsIdToken(id int) (token string, found bool) {
-	s.cacheMu.RLock()
-	token, found = s.statsTokenNew[id]
-	if found {
-		s.cacheMu.RUnlock()
-		return
-	}
-	token, found = s.statsTokenOld[id]
-	s.cacheMu.RUnlock()
-	if found {
-		s.cacheStatsTokenId(token, id)
-	}
-	return
+	s.stopPurging()
+	s.stats.close()
+	s.backend.Close()
 }
 
 var counterEpoch = time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
@@ -240,22 +104,26 @@ func timeToStamp(t time.Time) int32 {
 	return int32(t.Unix() - counterEpoch)
 }
 
+// stampPeriodTime returns the time reported for the period of kind by
+// holding the given stamp, which counts such periods since counterEpoch.
+func stampPeriodTime(by CounterRequestBy, stamp int64) time.Time {
+	switch by {
+	case ByDay:
+		stamp = stamp * 86400
+	case ByWeek:
+		// The +1 puts it at the end of the period.
+		stamp = (stamp + 1) * 604800
+	}
+	return time.Unix(counterEpoch+stamp, 0).In(time.UTC)
+}
+
 // IncCounter increases by one the counter associated with the composed key.
 func (s *Store) IncCounter(key []string) error {
-	session := s.session.Copy()
-	defer session.Close()
-
-	skey, err := s.statsKey(session, key, true)
-	if err != nil {
-		return err
+	if len(key) == 0 {
+		return fmt.Errorf("store: empty statistics key")
 	}
-
-	t := time.Now().UTC()
 	// Round to the start of the minute so we get one document per minute at most.
-	t = t.Add(-time.Duration(t.Second()) * time.Second)
-	counters := session.StatCounters()
-	_, err = counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(t)}}, bson.D{{"$inc", bson.D{{"c", 1}}}})
-	return err
+	return s.backend.IncCounter(key, counterTime(time.Now()))
 }
 
 // CounterRequest represents a request to aggregate counter values.
@@ -323,146 +191,13 @@ type Counter struct {
 
 // Counters aggregates and returns counter values according to the provided request.
 func (s *Store) Counters(req *CounterRequest) ([]Counter, error) {
-	session := s.session.Copy()
-	defer session.Close()
-
-	tokensColl := session.StatTokens()
-	countersColl := session.StatCounters()
-
-	searchKey, err := s.statsKey(session, req.Key, false)
-	if err == ErrNotFound {
-		if !req.List {
-			return []Counter{{Key: req.Key, Prefix: req.Prefix, Count: 0}}, nil
-		}
-		return nil, nil
+	if len(req.Key) == 0 {
+		return nil, fmt.Errorf("store: empty statistics key")
 	}
+	counters, err := s.backend.Counters(req)
 	if err != nil {
 		return nil, err
 	}
-	var regex string
-	if req.Prefix {
-		regex = "^" + searchKey + ".+"
-	} else {
-		regex = "^" + searchKey + "$"
-	}
-
-	// This reduce function simply sums, for each emitted key, all the values found under it.
-	job := mgo.MapReduce{Reduce: "function(key, values) { return Array.sum(values); }"}
-	var emit string
-	switch req.By {
-	case ByDay:
-		emit = "emit(k+'@'+NumberInt(this.t/86400), this.c);"
-	case ByWeek:
-		emit = "emit(k+'@'+NumberInt(this.t/604800), this.c);"
-	default:
-		emit = "emit(k, this.c);"
-	}
-	if req.List && req.Prefix {
-		// For a search key "a:b:" matching a key "a:b:c:d:e:", this map function emits "a:b:c:*".
-		// For a search key "a:b:" matching a key "a:b:c:", it emits "a:b:c:".
-		// For a search key "a:b:" matching a key "a:b:", it emits "a:b:".
-		job.Scope = bson.D{{"searchKeyLen", len(searchKey)}}
-		job.Map = fmt.Sprintf(`
-			function() {
-				var k = this.k;
-				var i = k.indexOf(':', searchKeyLen)+1;
-				if (k.length > i)  { k = k.substr(0, i)+'*'; }
-				%s
-			}`, emit)
-	} else {
-		// For a search key "a:b:" matching a key "a:b:c:d:e:", this map function emits "a:b:*".
-		// For a search key "a:b:" matching a key "a:b:c:", it also emits "a:b:*".
-		// For a search key "a:b:" matching a key "a:b:", it emits "a:b:".
-		emitKey := searchKey
-		if req.Prefix {
-			emitKey += "*"
-		}
-		job.Scope = bson.D{{"emitKey", emitKey}}
-		job.Map = fmt.Sprintf(`
-			function() {
-				var k = emitKey;
-				%s
-			}`, emit)
-	}
-
-	var result []struct {
-		Key   string `bson:"_id"`
-		Value int64
-	}
-	var query, tquery bson.D
-	if !req.Start.IsZero() {
-		tquery = append(tquery, bson.DocElem{
-			Name:  "$gte",
-			Value: timeToStamp(req.Start),
-		})
-	}
-	if !req.Stop.IsZero() {
-		tquery = append(tquery, bson.DocElem{
-			Name:  "$lte",
-			Value: timeToStamp(req.Stop),
-		})
-	}
-	if len(tquery) == 0 {
-		query = bson.D{{"k", bson.D{{"$regex", regex}}}}
-	} else {
-		query = bson.D{{"k", bson.D{{"$regex", regex}}}, {"t", tquery}}
-	}
-	_, err = countersColl.Find(query).MapReduce(&job, &result)
-	if err != nil {
-		return nil, err
-	}
-	var counters []Counter
-	for i := range result {
-		key := result[i].Key
-		when := time.Time{}
-		if req.By != ByAll {
-			var stamp int64
-			if at := strings.Index(key, "@"); at != -1 && len(key) > at+1 {
-				stamp, _ = strconv.ParseInt(key[at+1:], 10, 32)
-				key = key[:at]
-			}
-			if stamp == 0 {
-				return nil, fmt.Errorf("internal error: bad aggregated key: %q", result[i].Key)
-			}
-			switch req.By {
-			case ByDay:
-				stamp = stamp * 86400
-			case ByWeek:
-				// The +1 puts it at the end of the period.
-				stamp = (stamp + 1) * 604800
-			}
-			when = time.Unix(counterEpoch+stamp, 0).In(time.UTC)
-		}
-		ids := strings.Split(key, ":")
-		tokens := make([]string, 0, len(ids))
-		for i := 0; i < len(ids)-1; i++ {
-			if ids[i] == "*" {
-				continue
-			}
-			id, err := strconv.ParseInt(ids[i], 32, 32)
-			if err != nil {
-				return nil, fmt.Errorf("store: invalid id: %q", ids[i])
-			}
-			token, found := s.statsIdToken(int(id))
-			if !found {
-				var t tokenId
-				err = tokensColl.FindId(id).One(&t)
-				if err == mgo.ErrNotFound {
-					return nil, fmt.Errorf("store: internal error; token id not found: %d", id)
-				}
-				s.cacheStatsTokenId(t.Token, t.Id)
-				token = t.Token
-			}
-			tokens = append(tokens, token)
-		}
-		counter := Counter{
-			Key:    tokens,
-			Prefix: len(ids) > 0 && ids[len(ids)-1] == "*",
-			Count:  result[i].Value,
-			Time:   when,
-		}
-		counters = append(counters, counter)
-	}
 	if !req.List && len(counters) == 0 {
 		counters = []Counter{{Key: req.Key, Prefix: req.Prefix, Count: 0}}
 	} else if len(counters) > 1 {
@@ -529,6 +264,8 @@ var _ CharmDir = (*charm.Dir)(nil)
 // Publish bundles charm and writes it to the store. The written charm
 // bundle will have its revision set to the result of Revision.
 // Publish must be called only once for a CharmPublisher.
+// Errors caused by the store rather than by the charm satisfy
+// IsTransient, except for ErrUpdateConflict.
 func (p *CharmPublisher) Publish(charm CharmDir) error {
 	w := p.w
 	if w == nil {
@@ -538,49 +275,102 @@ func (p *CharmPublisher) Publish(charm CharmDir) error {
 	w.charm = charm
 	// TODO: Refactor to BundleTo(w, revision)
 	charm.SetRevision(p.revision)
-	err := charm.BundleTo(w)
+	err := w.policy.checkContent(charm)
+	if err == nil {
+		err = charm.BundleTo(w)
+	}
 	if err == nil {
 		err = w.finish()
+		if err != ErrUpdateConflict {
+			err = transient(err)
+		}
 	} else {
 		w.abort()
+		if w.policyErr != nil {
+			err = w.policyErr
+		} else if w.err != nil {
+			err = transient(err)
+		}
 	}
 	return err
 }
 
+// DryRun bundles charm as Publish would, but rather than writing the
+// bundle to the store it only computes its SHA256 hash and size. The
+// bundle must still comply with the bundle policy in effect. Neither
+// DryRun nor Publish may be called again for the CharmPublisher.
+func (p *CharmPublisher) DryRun(charm CharmDir) (bundleSha256 string, size int64, err error) {
+	w := p.w
+	if w == nil {
+		panic("CharmPublisher already published a charm")
+	}
+	p.w = nil
+	charm.SetRevision(p.revision)
+	if err := w.policy.checkContent(charm); err != nil {
+		return "", 0, err
+	}
+	hw := &hashWriter{hash: sha256.New(), policy: w.policy}
+	if err := charm.BundleTo(hw); err != nil {
+		if hw.policyErr != nil {
+			return "", 0, hw.policyErr
+		}
+		return "", 0, err
+	}
+	return hex.EncodeToString(hw.hash.Sum(nil)), hw.size, nil
+}
+
+// hashWriter is an io.Writer that computes the SHA256 hash and size of
+// charm bundles without storing them.
+type hashWriter struct {
+	hash      hash.Hash
+	size      int64
+	policy    BundlePolicy
+	policyErr *PolicyError
+}
+
+func (w *hashWriter) Write(data []byte) (n int, err error) {
+	if perr := w.policy.checkSize(w.size + int64(len(data))); perr != nil {
+		w.policyErr = perr
+		return 0, perr
+	}
+	w.hash.Write(data)
+	w.size += int64(len(data))
+	return len(data), nil
+}
+
 // CharmPublisher returns a new CharmPublisher for importing a charm that
 // will be made available in the store at all of the provided URLs.
 // The digest parameter must contain the unique identifier that
 // represents the charm data being imported (e.g. the VCS revision sha1).
 // ErrRedundantUpdate is returned if all of the provided urls are
-// already associated to that digest.
+// already associated to that digest. Publishers holding an update lock
+// over urls must use UpdateLock.CharmPublisher instead.
 func (s *Store) CharmPublisher(urls []*charm.URL, digest string) (p *CharmPublisher, err error) {
 	logger.Infof("trying to add charms %v with key %q...", urls, digest)
 	if err = mustLackRevision("CharmPublisher", urls...); err != nil {
 		return
 	}
-	session := s.session.Copy()
-	defer session.Close()
-
 	maxRev := -1
 	newKey := false
-	charms := session.Charms()
-	doc := charmDoc{}
 	for i := range urls {
-		urlStr := urls[i].String()
-		err = charms.Find(bson.D{{"urls", urlStr}}).Sort("-revision").One(&doc)
-		if err == mgo.ErrNotFound {
+		var docs []*CharmDoc
+		// Soft-deleted revisions are taken into account so
+		// that they may be undeleted later.
+		docs, err = s.backend.FindCharms(urls[i], 1, IncludeDeleted)
+		if err != nil {
+			logger.Errorf("unknown error looking for charm %s: %s", urls[i], err)
+			return
+		}
+		if len(docs) == 0 {
 			logger.Infof("charm %s not yet in the store.", urls[i])
 			newKey = true
 			continue
 		}
+		doc := docs[0]
 		if doc.Digest != digest {
-			logger.Infof("charm %s is out of date with revision key %q.", urlStr, digest)
+			logger.Infof("charm %s is out of date with revision key %q.", urls[i], digest)
 			newKey = true
 		}
-		if err != nil {
-			logger.Errorf("unknown error looking for charm %s: %s", urlStr, err)
-			return
-		}
 		if doc.Revision > maxRev {
 			maxRev = doc.Revision
 		}
@@ -597,94 +387,162 @@ func (s *Store) CharmPublisher(urls []*charm.URL, digest string) (p *CharmPublis
 		urls:     urls,
 		revision: revision,
 		digest:   digest,
+		policy:   s.bundlePolicy(urls),
 	}
 	return &CharmPublisher{revision, w}, nil
 }
 
-// charmWriter is an io.Writer that writes charm bundles to the charms GridFS.
+// charmWriter is an io.Writer that writes charm bundles to the store blobs.
 type charmWriter struct {
 	store    *Store
-	session  *storeSession
-	file     *mgo.GridFile
+	blob     BlobWriter
 	sha256   hash.Hash
+	size     int64
 	charm    CharmDir
 	urls     []*charm.URL
 	revision int
 	digest   string
+	lock     *UpdateLock
+	policy   BundlePolicy
+
+	// err holds the error that prevented writing to the store, if any.
+	err error
+
+	// policyErr holds the policy violation that prevented writing
+	// the bundle, if any.
+	policyErr *PolicyError
 }
 
-// Write creates an entry in the charms GridFS when first called,
+// Write creates a blob in the store when first called,
 // and streams all written data into it.
 func (w *charmWriter) Write(data []byte) (n int, err error) {
-	if w.file == nil {
-		w.session = w.store.session.Copy()
-		w.file, err = w.session.CharmFS().Create("")
+	if w.blob == nil {
+		w.blob, err = w.store.backend.CreateBlob()
 		if err != nil {
-			logger.Errorf("failed to create GridFS file: %v", err)
+			w.err = err
 			return 0, err
 		}
 		w.sha256 = sha256.New()
-		logger.Infof("creating GridFS file with id %q...", w.file.Id().(bson.ObjectId).Hex())
+	}
+	if perr := w.policy.checkSize(w.size + int64(len(data))); perr != nil {
+		w.policyErr = perr
+		return 0, perr
 	}
 	_, err = w.sha256.Write(data)
 	if err != nil {
 		panic("hash.Hash should never error")
 	}
-	return w.file.Write(data)
+	n, err = w.blob.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
 }
 
 // abort cancels the charm writing.
 func (w *charmWriter) abort() {
-	if w.file != nil {
-		// Ignore error. Already aborting due to a preceding bad situation
-		// elsewhere. This error is not important right now.
-		_ = w.file.Close()
-		w.session.Close()
+	if w.blob != nil {
+		w.blob.Abort()
 	}
 }
 
 // finish completes the charm writing process and inserts the final metadata.
 // After it completes the charm will be available for consumption.
 func (w *charmWriter) finish() error {
-	if w.file == nil {
+	if w.blob == nil {
 		return nil
 	}
-	defer w.session.Close()
-	id := w.file.Id()
-	size := w.file.Size()
-	err := w.file.Close()
+	backend := w.store.backend
+	sha256 := hex.EncodeToString(w.sha256.Sum(nil))
+	id, err := backend.RefBlob(sha256)
+	switch err {
+	case nil:
+		logger.Infof("bundle with hash %s already stored; reusing it.", sha256)
+		w.blob.Abort()
+	case ErrNotFound:
+		id, err = w.finishBlob(sha256)
+	default:
+		w.blob.Abort()
+	}
 	if err != nil {
-		logger.Errorf("failed to close GridFS file: %v", err)
 		return err
 	}
-	charms := w.session.Charms()
-	sha256 := hex.EncodeToString(w.sha256.Sum(nil))
-	charm := charmDoc{
+	charm := CharmDoc{
 		w.urls,
 		w.revision,
 		w.digest,
 		sha256,
-		size,
-		id.(bson.ObjectId),
+		w.size,
+		id,
 		w.charm.Meta(),
 		w.charm.Config(),
+		nil,
+		bson.Now(),
+	}
+	// The lock is checked as the charm is recorded, so that a
+	// publisher that lost it can't overwrite the work of the new
+	// holder.
+	lockToken := ""
+	if w.lock != nil {
+		lockToken = w.lock.token
 	}
-	if err = charms.Insert(&charm); err != nil {
-		err = maybeConflict(err)
+	if err = backend.InsertCharm(&charm, lockToken); err != nil {
 		logger.Errorf("failed to insert new revision of charm %v: %v", w.urls, err)
+		if rerr := w.store.releaseBlob(sha256, id, ""); rerr != nil {
+			logger.Errorf("failed to release bundle with hash %s: %v", sha256, rerr)
+		}
 		return err
 	}
 	return nil
 }
 
+// finishBlob stores the written blob and records it as holding data
+// with the given hash.
+func (w *charmWriter) finishBlob(sha256 string) (BlobId, error) {
+	backend := w.store.backend
+	id, err := w.blob.Finish(sha256)
+	if err != nil {
+		return "", err
+	}
+	err = backend.InsertBlobRef(sha256, id)
+	if err == nil {
+		return id, nil
+	}
+	if err != ErrUpdateConflict {
+		w.removeBlob(id)
+		return "", err
+	}
+	// A concurrent publisher stored the same data first.
+	existing, err := backend.RefBlob(sha256)
+	if err != nil {
+		w.removeBlob(id)
+		return "", err
+	}
+	if existing != id {
+		w.removeBlob(id)
+	}
+	return existing, nil
+}
+
+// removeBlob removes the finished blob with the given id, which no
+// charm refers to.
+func (w *charmWriter) removeBlob(id BlobId) {
+	if err := w.store.backend.RemoveBlob(id); err != nil {
+		logger.Errorf("failed to remove unreferenced bundle %s: %v", id, err)
+	}
+}
+
 type CharmInfo struct {
 	revision int
 	digest   string
 	sha256   string
 	size     int64
-	fileId   bson.ObjectId
+	fileId   BlobId
 	meta     *charm.Meta
 	config   *charm.Config
+	deletion *CharmDeletion
+	time     time.Time
 }
 
 // Statically ensure CharmInfo is a charm.Charm.
@@ -721,6 +579,18 @@ func (ci *CharmInfo) Config() *charm.Config {
 	return ci.config
 }
 
+// Deletion returns the details of the soft deletion of the stored
+// charm, or nil if it isn't soft-deleted.
+func (ci *CharmInfo) Deletion() *CharmDeletion {
+	return ci.deletion
+}
+
+// Time returns when the stored charm was published, or the zero time
+// if that's unknown.
+func (ci *CharmInfo) Time() time.Time {
+	return ci.time
+}
+
 var ltsReleases = map[string]bool{
 	"lucid":   true,
 	"precise": true,
@@ -743,18 +613,7 @@ func (s byPreferredSeries) Less(i, j int) bool {
 // Series returns all the series available for a charm reference, in descending
 // order of preference. LTS releases preferred over non-LTS
 func (s *Store) Series(ref charm.Reference) ([]string, error) {
-	session := s.session.Copy()
-	defer session.Close()
-
-	patternURL := &charm.URL{Reference: ref, Series: "[a-z][^/]+"}
-	patternURL = patternURL.WithRevision(-1)
-
-	charms := session.Charms()
-	q := charms.Find(bson.M{
-		"urls": bson.RegEx{Pattern: fmt.Sprintf("^%s$", patternURL.String())},
-	})
-	var cdocs []charmDoc
-	err := q.All(&cdocs)
+	cdocs, err := s.backend.FindCharmsByReference(ref)
 	if err != nil {
 		return nil, err
 	}
@@ -778,50 +637,41 @@ func (s *Store) Series(ref charm.Reference) ([]string, error) {
 	return result, nil
 }
 
-// getRevisions returns at most the last n revisions for charm at url,
-// in descending revision order. For limit n=0, all revisions are returned.
-func (s *Store) getRevisions(url *charm.URL, n int) ([]*CharmInfo, error) {
-	session := s.session.Copy()
-	defer session.Close()
-
+// getRevisions returns at most the last n revisions for charm at url
+// selected by filter, in descending revision order. For limit n=0, all
+// revisions are returned.
+func (s *Store) getRevisions(url *charm.URL, n int, filter DeletedFilter) ([]*CharmInfo, error) {
 	logger.Debugf("retrieving charm info for %s", url)
-	rev := url.Revision
-	url = url.WithRevision(-1)
-
-	charms := session.Charms()
-	var cdocs []charmDoc
-	var qdoc interface{}
-	if rev == -1 {
-		qdoc = bson.D{{"urls", url}}
-	} else {
-		qdoc = bson.D{{"urls", url}, {"revision", rev}}
-	}
-	q := charms.Find(qdoc).Sort("-revision")
-	if n > 0 {
-		q = q.Limit(n)
-	}
-	if err := q.All(&cdocs); err != nil {
+	cdocs, err := s.backend.FindCharms(url, n, filter)
+	if err != nil {
 		logger.Errorf("failed to find charm %s: %v", url, err)
 		return nil, ErrNotFound
 	}
 	var infos []*CharmInfo
 	for _, cdoc := range cdocs {
-		infos = append(infos, &CharmInfo{
-			cdoc.Revision,
-			cdoc.Digest,
-			cdoc.Sha256,
-			cdoc.Size,
-			cdoc.FileId,
-			cdoc.Meta,
-			cdoc.Config,
-		})
+		infos = append(infos, newCharmInfo(cdoc))
 	}
 	return infos, nil
 }
 
+func newCharmInfo(cdoc *CharmDoc) *CharmInfo {
+	return &CharmInfo{
+		cdoc.Revision,
+		cdoc.Digest,
+		cdoc.Sha256,
+		cdoc.Size,
+		cdoc.FileId,
+		cdoc.Meta,
+		cdoc.Config,
+		cdoc.Deleted,
+		cdoc.Time,
+	}
+}
+
 // CharmInfo retrieves the CharmInfo value for the charm at url.
+// Soft-deleted revisions are not considered.
 func (s *Store) CharmInfo(url *charm.URL) (*CharmInfo, error) {
-	infos, err := s.getRevisions(url, 1)
+	infos, err := s.getRevisions(url, 1, ExcludeDeleted)
 	if err != nil {
 		logger.Errorf("failed to find charm %s: %v", url, err)
 		return nil, ErrNotFound
@@ -839,118 +689,379 @@ func (s *Store) OpenCharm(url *charm.URL) (info *CharmInfo, rc io.ReadCloser, er
 	if err != nil {
 		return nil, nil, err
 	}
-	session := s.session.Copy()
-	file, err := session.CharmFS().OpenId(info.fileId)
+	rc, err = s.backend.OpenBlob(info.fileId)
 	if err != nil {
-		logger.Errorf("failed to open GridFS file for charm %s: %v", url, err)
-		session.Close()
+		logger.Errorf("failed to open bundle for charm %s: %v", url, err)
 		return nil, nil, err
 	}
-	rc = &reader{session, file}
 	return
 }
 
 // DeleteCharm deletes the charms matching url. If no revision is specified,
-// all revisions of the charm are deleted.
+// all revisions of the charm are deleted, including soft-deleted ones.
+//
+// The deletion is all or nothing: it's recorded before being applied,
+// and if it fails midway it is finished the next time the store is
+// opened. No revisions are returned in that case.
 func (s *Store) DeleteCharm(url *charm.URL) ([]*CharmInfo, error) {
 	logger.Debugf("deleting charm %s", url)
-	infos, err := s.getRevisions(url, 0)
+	infos, err := s.getRevisions(url, 0, IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, ErrNotFound
+	}
+	if err := s.deleteRevisions(url, infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// deleteRevisions permanently deletes the given revisions of the charm
+// at url.
+func (s *Store) deleteRevisions(url *charm.URL, infos []*CharmInfo) error {
+	intent := &DeleteIntent{
+		Id:   bson.NewObjectId().Hex(),
+		URL:  url.WithRevision(-1),
+		Time: bson.Now(),
+	}
+	for _, info := range infos {
+		intent.Revisions = append(intent.Revisions, &DeleteRevision{
+			Revision: info.Revision(),
+			Sha256:   info.sha256,
+			BlobId:   info.fileId,
+			Time:     info.time,
+		})
+	}
+	if err := s.backend.InsertDeleteIntent(intent); err != nil {
+		logger.Errorf("failed to record deletion of charm %s: %v", url, err)
+		return err
+	}
+	if err := s.applyDeleteIntent(intent, false); err != nil {
+		logger.Errorf("failed to delete charm %s: %v", url, err)
+		return err
+	}
+	return nil
+}
+
+// SoftDeleteCharm hides the charms matching url, recording that they
+// were deleted by the given user. If no revision is specified, all
+// revisions of the charm are hidden. Hidden revisions may be restored
+// with UndeleteCharm, until they're purged by PurgeDeletedCharms.
+func (s *Store) SoftDeleteCharm(url *charm.URL, by string) ([]*CharmInfo, error) {
+	logger.Debugf("soft-deleting charm %s", url)
+	infos, err := s.getRevisions(url, 0, ExcludeDeleted)
 	if err != nil {
 		return nil, err
 	}
 	if len(infos) == 0 {
 		return nil, ErrNotFound
 	}
-	session := s.session.Copy()
-	defer session.Close()
-	var deleted []*CharmInfo
+	deletion := &CharmDeletion{By: by, Time: bson.Now()}
 	for _, info := range infos {
-		err := session.Charms().Remove(
-			bson.D{{"urls", url.WithRevision(-1)}, {"revision", info.Revision()}})
+		err := s.backend.SetCharmDeletion(url.WithRevision(-1), info.Revision(), deletion)
 		if err != nil {
-			logger.Errorf("failed to delete metadata for charm %s: %v", url, err)
-			return deleted, err
+			logger.Errorf("failed to soft-delete charm %s: %v", url, err)
+			return nil, err
 		}
-		err = session.CharmFS().RemoveId(info.fileId)
+		info.deletion = deletion
+	}
+	return infos, nil
+}
+
+// UndeleteCharm restores the soft-deleted charms matching url. If no
+// revision is specified, all soft-deleted revisions of the charm are
+// restored. The returned revisions hold the details of their deletion.
+func (s *Store) UndeleteCharm(url *charm.URL) ([]*CharmInfo, error) {
+	logger.Debugf("undeleting charm %s", url)
+	infos, err := s.getRevisions(url, 0, OnlyDeleted)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, ErrNotFound
+	}
+	for _, info := range infos {
+		err := s.backend.SetCharmDeletion(url.WithRevision(-1), info.Revision(), nil)
 		if err != nil {
-			logger.Errorf("failed to delete GridFS file for charm %s: %v", url, err)
-			return deleted, err
+			logger.Errorf("failed to undelete charm %s: %v", url, err)
+			return nil, err
 		}
-		deleted = append(deleted, info)
 	}
-	return deleted, err
+	return infos, nil
 }
 
-type reader struct {
-	session *storeSession
-	file    *mgo.GridFile
+// PurgeDeletedCharms permanently deletes the charm revisions that were
+// soft-deleted more than the given age ago, and returns their URLs.
+// Charm deletions abandoned midway are also finished.
+func (s *Store) PurgeDeletedCharms(age time.Duration) ([]*charm.URL, error) {
+	if err := s.recoverDeletes(); err != nil {
+		return nil, err
+	}
+	cdocs, err := s.backend.FindDeletedCharms(bson.Now().Add(-age))
+	if err != nil {
+		return nil, err
+	}
+	var purged []*charm.URL
+	for _, cdoc := range cdocs {
+		url := cdoc.URLs[0].WithRevision(cdoc.Revision)
+		logger.Infof("purging charm %s deleted by %q at %v", url, cdoc.Deleted.By, cdoc.Deleted.Time)
+		if err := s.deleteRevisions(url, []*CharmInfo{newCharmInfo(cdoc)}); err != nil {
+			return purged, err
+		}
+		purged = append(purged, url)
+	}
+	return purged, nil
+}
+
+// DeleteIntentTimeout is how long a charm deletion may take before it's
+// considered abandoned, and is finished by the next store opened.
+var DeleteIntentTimeout = 10 * time.Minute
+
+// recoverDeletes finishes the pending charm deletions that were
+// abandoned. Deletions started less than DeleteIntentTimeout ago may
+// still be running elsewhere, and are left alone.
+func (s *Store) recoverDeletes() error {
+	intents, err := s.backend.DeleteIntents()
+	if err != nil {
+		return err
+	}
+	expired := bson.Now().Add(-DeleteIntentTimeout)
+	for _, intent := range intents {
+		if intent.Time.After(expired) {
+			logger.Infof("deletion of charm %s is still in progress", intent.URL)
+			continue
+		}
+		logger.Infof("finishing deletion of charm %s", intent.URL)
+		if err := s.applyDeleteIntent(intent, true); err != nil {
+			return fmt.Errorf("cannot finish deletion of charm %s: %v", intent.URL, err)
+		}
+	}
+	return nil
 }
 
-// Read consumes data from the opened charm.
-func (r *reader) Read(buf []byte) (n int, err error) {
-	return r.file.Read(buf)
+// applyDeleteIntent deletes the charm revisions recorded in intent, and
+// then forgets about it. Applying an intent more than once is harmless.
+// When recovering, the charm metadata may already have been deleted by
+// an earlier attempt, so the bundle is released regardless. The token
+// used to release it is shared by all the intents deleting the same
+// revision, so that the reference is dropped only once.
+func (s *Store) applyDeleteIntent(intent *DeleteIntent, recovering bool) error {
+	for _, rev := range intent.Revisions {
+		err := s.backend.RemoveCharm(intent.URL, rev.Revision)
+		if err == ErrNotFound && !recovering {
+			// Deleted concurrently, so the bundle was released
+			// elsewhere.
+			continue
+		}
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		err = s.releaseBlob(rev.Sha256, rev.BlobId, intent.token(rev))
+		if err != nil {
+			return err
+		}
+	}
+	return s.backend.RemoveDeleteIntent(intent)
 }
 
-// Close closes the opened charm and frees associated resources.
-func (r *reader) Close() error {
-	err := r.file.Close()
-	r.session.Close()
+// releaseBlob drops a reference to the blob with the given hash and id,
+// and removes the blob once it's no longer referenced. A non-empty
+// token makes the operation idempotent, as described in
+// Backend.UnrefBlob.
+func (s *Store) releaseBlob(sha256 string, id BlobId, token string) error {
+	removed, err := s.backend.UnrefBlob(sha256, id, token)
+	if err == ErrNotFound {
+		// Blobs stored before reference counting was in place
+		// have a single reference.
+		removed, err = true, nil
+	}
+	if err != nil || !removed {
+		return err
+	}
+	err = s.backend.RemoveBlob(id)
+	if err == ErrNotFound {
+		// Already removed by an earlier attempt.
+		return nil
+	}
 	return err
 }
 
-// charmDoc represents the document stored in MongoDB for a charm.
-type charmDoc struct {
-	URLs     []*charm.URL
-	Revision int
-	Digest   string
-	Sha256   string
-	Size     int64
-	FileId   bson.ObjectId
-	Meta     *charm.Meta
-	Config   *charm.Config
+// SyncTime returns the time of the last successful sync with the
+// given name, as recorded by SetSyncTime. If no sync was recorded, the
+// zero time is returned.
+func (s *Store) SyncTime(name string) (time.Time, error) {
+	t, err := s.backend.SyncTime(name)
+	if err == ErrNotFound {
+		return time.Time{}, nil
+	}
+	return t, err
+}
+
+// SetSyncTime records t as the time of the last successful sync with
+// the given name. Recording the zero time forces the next sync to
+// start over from scratch.
+func (s *Store) SetSyncTime(name string, t time.Time) error {
+	return s.backend.SetSyncTime(name, t)
+}
+
+// LockOwner identifies this process as the owner of the update locks
+// it acquires.
+var LockOwner = defaultLockOwner()
+
+func defaultLockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
 }
 
+// LockRenewInterval is how often acquired update locks are renewed so
+// that they don't expire while held.
+var LockRenewInterval = time.Duration(UpdateTimeout / 5)
+
 // LockUpdates acquires a server-side lock for updating a single charm
 // that is supposed to be made available in all of the provided urls.
 // If the lock can't be acquired in any of the urls, an error will be
 // immediately returned.
 // In the usual case, any locking done is undone when an error happens,
-// or when l.Unlock is called. If something else goes wrong, the locks
-// will also expire after the period defined in UpdateTimeout.
+// or when l.Unlock is called. While held, the lock is renewed every
+// LockRenewInterval. If something else goes wrong, the locks will also
+// expire after the period defined in UpdateTimeout.
 func (s *Store) LockUpdates(urls []*charm.URL) (l *UpdateLock, err error) {
-	session := s.session.Copy()
 	keys := make([]string, len(urls))
 	for i := range urls {
 		keys[i] = urls[i].String()
 	}
 	sort.Strings(keys)
-	l = &UpdateLock{keys, session.Locks(), bson.Now()}
+	l = &UpdateLock{
+		store:   s,
+		urls:    urls,
+		keys:    keys,
+		backend: s.backend,
+		owner:   LockOwner,
+		token:   bson.NewObjectId().Hex(),
+		time:    bson.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
 	if err = l.tryLock(); err != nil {
-		session.Close()
 		return nil, err
 	}
+	go l.renewLoop()
 	return l, nil
 }
 
 // UpdateLock represents an acquired update lock over a set of charm URLs.
 type UpdateLock struct {
-	keys  []string
-	locks *mgo.Collection
-	time  time.Time
+	store   *Store
+	urls    []*charm.URL
+	keys    []string
+	backend Backend
+	owner   string
+	token   string
+	time    time.Time
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mu   sync.Mutex
+	lost bool
+}
+
+// CharmPublisher returns a CharmPublisher for the charm at the locked
+// URLs, as Store.CharmPublisher does. The charm is only recorded by
+// the publisher if the lock is still held at the time, so that a
+// publisher that lost its lock can't overwrite the work of the new
+// holder. Otherwise Publish fails with ErrUpdateConflict.
+func (l *UpdateLock) CharmPublisher(digest string) (*CharmPublisher, error) {
+	p, err := l.store.CharmPublisher(l.urls, digest)
+	if err != nil {
+		return nil, err
+	}
+	p.w.lock = l
+	return p, nil
 }
 
 // Unlock removes the previously acquired server-side lock that prevents
-// other processes from attempting to update a set of charm URLs.
+// other processes from attempting to update a set of charm URLs. It may
+// be called more than once.
 func (l *UpdateLock) Unlock() {
+	l.once.Do(l.unlock)
+}
+
+func (l *UpdateLock) unlock() {
+	close(l.stop)
+	<-l.done
 	logger.Debugf("unlocking charms for future updates: %v", l.keys)
-	defer l.locks.Database.Session.Close()
 	for i := len(l.keys) - 1; i >= 0; i-- {
-		// Using time below ensures only the proper lock is removed.
+		// Using the token below ensures only the proper lock is removed.
 		// Can't do much about errors here. Locks will expire anyway.
-		l.locks.Remove(bson.D{{"_id", l.keys[i]}, {"time", l.time}})
+		l.backend.RemoveLock(l.keys[i], l.token)
 	}
 }
 
+// renewLoop renews the lock periodically until it's unlocked or lost.
+func (l *UpdateLock) renewLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(LockRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+		if err := l.renew(); err == ErrUpdateConflict {
+			return
+		} else if err != nil {
+			// Try again later. The lock only expires after
+			// UpdateTimeout.
+			logger.Errorf("cannot renew lock on charms %v: %v", l.keys, err)
+		}
+	}
+}
+
+// renew renews the lock, and returns ErrUpdateConflict if it's no
+// longer held, either because it expired and was acquired by someone
+// else, or because it was forcefully released.
+func (l *UpdateLock) renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return ErrUpdateConflict
+	}
+	now := bson.Now()
+	for _, key := range l.keys {
+		err := l.backend.RenewLock(key, l.token, now)
+		if err == ErrUpdateConflict {
+			logger.Errorf("lost lock on charm %s held by %s", key, l.owner)
+			l.lost = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Locks returns all the update locks currently held, ordered by key.
+// The key of a lock is the charm URL it's held over.
+func (s *Store) Locks() ([]*LockDoc, error) {
+	return s.backend.Locks()
+}
+
+// BreakLock forcefully releases the update lock with the given key,
+// no matter who holds it. The former holder will fail to publish with
+// ErrUpdateConflict. If no such lock is held, the error ErrNotFound is
+// returned.
+func (s *Store) BreakLock(key string) error {
+	logger.Warningf("breaking update lock on %s", key)
+	return s.backend.BreakLock(key)
+}
+
 // tryLock tries locking l.keys, one at a time, and succeeds only if it
 // can lock all of them in order. The keys should be pre-sorted so that
 // two-way conflicts can't happen. If any of the keys fail to be locked,
@@ -959,16 +1070,22 @@ func (l *UpdateLock) Unlock() {
 func (l *UpdateLock) tryLock() error {
 	for i, key := range l.keys {
 		logger.Debugf("trying to lock charm %s for updates...", key)
-		doc := bson.D{{"_id", key}, {"time", l.time}}
-		err := l.locks.Insert(doc)
+		lock := &LockDoc{
+			Key:      key,
+			Owner:    l.owner,
+			Token:    l.token,
+			Acquired: l.time,
+			Time:     l.time,
+		}
+		err := l.backend.InsertLock(lock)
 		if err == nil {
 			logger.Debugf("charm %s is now locked for updates.", key)
 			continue
 		}
-		if lerr, ok := err.(*mgo.LastError); ok && lerr.Code == 11000 {
+		if err == ErrUpdateConflict {
 			logger.Debugf("charm %s is locked. Trying to expire lock.", key)
 			l.tryExpire(key)
-			err = l.locks.Insert(doc)
+			err = l.backend.InsertLock(lock)
 			if err == nil {
 				logger.Debugf("charm %s is now locked for updates.", key)
 				continue
@@ -976,11 +1093,10 @@ func (l *UpdateLock) tryLock() error {
 		}
 		// Couldn't lock everyone. Undo previous locks.
 		for j := i - 1; j >= 0; j-- {
-			// Using time below should be unnecessary, but it's an extra check.
+			// Using the token below should be unnecessary, but it's an extra check.
 			// Can't do anything about errors here. Lock will expire anyway.
-			l.locks.Remove(bson.D{{"_id", l.keys[j]}, {"time", l.time}})
+			l.backend.RemoveLock(l.keys[j], l.token)
 		}
-		err = maybeConflict(err)
 		logger.Errorf("can't lock charms %v for updating: %v", l.keys, err)
 		return err
 	}
@@ -990,57 +1106,7 @@ func (l *UpdateLock) tryLock() error {
 // tryExpire attempts to remove outdated locks from the database.
 func (l *UpdateLock) tryExpire(key string) {
 	// Ignore errors. If nothing happens the key will continue locked.
-	l.locks.Remove(bson.D{{"_id", key}, {"time", bson.D{{"$lt", bson.Now().Add(-UpdateTimeout)}}}})
-}
-
-// maybeConflict returns an ErrUpdateConflict if err is a mgo
-// insert conflict LastError, or err itself otherwise.
-func maybeConflict(err error) error {
-	if lerr, ok := err.(*mgo.LastError); ok && lerr.Code == 11000 {
-		return ErrUpdateConflict
-	}
-	return err
-}
-
-// storeSession wraps a mgo.Session ands adds a few convenience methods.
-type storeSession struct {
-	*mgo.Session
-}
-
-// Copy copies the storeSession and its underlying mgo session.
-func (s *storeSession) Copy() *storeSession {
-	return &storeSession{s.Session.Copy()}
-}
-
-// Charms returns the mongo collection where charms are stored.
-func (s *storeSession) Charms() *mgo.Collection {
-	return s.DB("juju").C("charms")
-}
-
-// CharmFS returns a mgo.GridFS to read and write charms.
-func (s *storeSession) CharmFS() *mgo.GridFS {
-	return s.DB("juju").GridFS("charmfs")
-}
-
-// Events returns the mongo collection where charm events are stored.
-func (s *storeSession) Events() *mgo.Collection {
-	return s.DB("juju").C("events")
-}
-
-// Locks returns the mongo collection where charm locks are stored.
-func (s *storeSession) Locks() *mgo.Collection {
-	return s.DB("juju").C("locks")
-}
-
-// StatTokens returns the mongo collection for storing key tokens
-// for statistics collection.
-func (s *storeSession) StatTokens() *mgo.Collection {
-	return s.DB("juju").C("stat.tokens")
-}
-
-// StatCounters returns the mongo collection for counter values.
-func (s *storeSession) StatCounters() *mgo.Collection {
-	return s.DB("juju").C("stat.counters")
+	l.backend.ExpireLock(key, bson.Now().Add(-UpdateTimeout))
 }
 
 type CharmEventKind int
@@ -1071,6 +1137,23 @@ type CharmEvent struct {
 	Errors   []string `bson:",omitempty"`
 	Warnings []string `bson:",omitempty"`
 	Time     time.Time
+
+	// Transient holds whether the publishing error may go away if
+	// publishing is attempted again.
+	Transient bool `bson:",omitempty"`
+
+	// Attempts holds the attempts made to publish the charm.
+	Attempts []PublishAttempt `bson:",omitempty"`
+
+	// Violation holds the bundle policy rule the charm broke, if
+	// that's why publishing failed.
+	Violation *PolicyError `bson:",omitempty"`
+}
+
+// PublishAttempt records an attempt to publish a charm.
+type PublishAttempt struct {
+	Time  time.Time
+	Error string `bson:",omitempty"`
 }
 
 // LogCharmEvent records an event related to one or more charm URLs.
@@ -1079,16 +1162,13 @@ func (s *Store) LogCharmEvent(event *CharmEvent) (err error) {
 	if err = mustLackRevision("LogCharmEvent", event.URLs...); err != nil {
 		return
 	}
-	session := s.session.Copy()
-	defer session.Close()
 	if event.Kind == 0 || event.Digest == "" || len(event.URLs) == 0 {
 		return fmt.Errorf("LogCharmEvent: need valid Kind, Digest and URLs")
 	}
 	if event.Time.IsZero() {
 		event.Time = time.Now()
 	}
-	events := session.Events()
-	return events.Insert(event)
+	return s.backend.InsertEvent(event)
 }
 
 // CharmEvent returns the most recent event associated with url
@@ -1102,25 +1182,7 @@ func (s *Store) CharmEvent(url *charm.URL, digest string) (*CharmEvent, error) {
 	if err := mustLackRevision("CharmEvent", url); err != nil {
 		return nil, err
 	}
-	session := s.session.Copy()
-	defer session.Close()
-
-	events := session.Events()
-	event := &CharmEvent{Digest: digest}
-	var query *mgo.Query
-	if digest == "" {
-		query = events.Find(bson.D{{"urls", url}})
-	} else {
-		query = events.Find(bson.D{{"urls", url}, {"digest", digest}})
-	}
-	err := query.Sort("-time").One(&event)
-	if err == mgo.ErrNotFound {
-		return nil, ErrNotFound
-	}
-	if err != nil {
-		return nil, err
-	}
-	return event, nil
+	return s.backend.FindEvent(url, digest)
 }
 
 // mustLackRevision returns an error if any of the urls has a revision.
@@ -4,6 +4,8 @@
 package store_test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -26,9 +28,12 @@ func Test(t *stdtesting.T) {
 	testing.MgoTestPackageSsl(t, false)
 }
 
-var _ = gc.Suite(&StoreSuite{})
+var _ = gc.Suite(&MgoStoreSuite{})
 var _ = gc.Suite(&TrivialSuite{})
 
+// StoreSuite holds the tests that apply to a store with any backend.
+// It sets up a store backed by MongoDB, and is run as part of
+// MgoStoreSuite and of the suites for the other backends.
 type StoreSuite struct {
 	testing.MgoSuite
 	testing.HTTPSuite
@@ -38,8 +43,21 @@ type StoreSuite struct {
 
 var noTestMongoJs *bool = flag.Bool("notest-mongojs", false, "Disable MongoDB tests that require javascript")
 
+// MgoStoreSuite runs the StoreSuite tests, along with the tests that
+// inspect the MongoDB collections behind the store directly.
+type MgoStoreSuite struct {
+	StoreSuite
+}
+
 type TrivialSuite struct{}
 
+// fastRetryStrategy replaces store.PublishRetryStrategy in tests.
+var fastRetryStrategy = store.RetryStrategy{
+	Attempts: 3,
+	Delay:    time.Millisecond,
+	MaxDelay: 5 * time.Millisecond,
+}
+
 func (s *StoreSuite) SetUpSuite(c *gc.C) {
 	s.BaseSuite.SetUpSuite(c)
 	s.MgoSuite.SetUpSuite(c)
@@ -60,6 +78,7 @@ func (s *StoreSuite) SetUpTest(c *gc.C) {
 	s.BaseSuite.SetUpTest(c)
 	s.MgoSuite.SetUpTest(c)
 	s.HTTPSuite.SetUpTest(c)
+	s.PatchValue(&store.PublishRetryStrategy, fastRetryStrategy)
 	var err error
 	s.store, err = store.Open(testing.MgoServer.Addr())
 	c.Assert(err, gc.IsNil)
@@ -208,6 +227,405 @@ func (s *StoreSuite) TestDeleteCharm(c *gc.C) {
 	c.Assert(err, gc.Not(gc.IsNil))
 }
 
+func (s *StoreSuite) TestBundleDeduplication(c *gc.C) {
+	urlA := charm.MustParseURL("cs:oneiric/wordpress")
+	urlB := charm.MustParseURL("cs:precise/wordpress")
+
+	// Both charms get revision 0, so their bundles are identical.
+	var infos []*store.CharmInfo
+	for _, url := range []*charm.URL{urlA, urlB} {
+		pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+		info, err := s.store.CharmInfo(url)
+		c.Assert(err, gc.IsNil)
+		infos = append(infos, info)
+	}
+	id := store.CharmInfoBlobId(infos[0])
+	c.Assert(store.CharmInfoBlobId(infos[1]), gc.Equals, id)
+
+	// Deleting one of the charms keeps the shared bundle.
+	_, err := s.store.DeleteCharm(urlA)
+	c.Assert(err, gc.IsNil)
+	_, rc, err := s.store.OpenCharm(urlB)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	c.Assert(string(data), gc.Equals, "charm-revision-0")
+
+	// Once no charm refers to it, it's gone.
+	_, err = s.store.DeleteCharm(urlB)
+	c.Assert(err, gc.IsNil)
+	_, err = store.StoreBackend(s.store).OpenBlob(id)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestSoftDeleteCharm(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	for i := 0; i < 2; i++ {
+		pub, err := s.store.CharmPublisher([]*charm.URL{url}, fmt.Sprintf("digest-%d", i))
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+	}
+
+	// Hiding the last revision exposes the previous one.
+	infos, err := s.store.SoftDeleteCharm(url.WithRevision(1), "bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Deletion().By, gc.Equals, "bob")
+	info, err := s.store.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	_, _, err = s.store.OpenCharm(url.WithRevision(1))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// Hiding all revisions hides the charm.
+	infos, err = s.store.SoftDeleteCharm(url, "alice")
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	_, err = s.store.CharmInfo(url)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	series, err := s.store.Series(url.Reference)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.HasLen, 0)
+	_, err = s.store.SoftDeleteCharm(url, "alice")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// New revisions don't clash with the hidden ones.
+	pub, err := s.store.CharmPublisher([]*charm.URL{url}, "digest-2")
+	c.Assert(err, gc.IsNil)
+	c.Assert(pub.Revision(), gc.Equals, 2)
+
+	// Undeleting reports who deleted each revision.
+	infos, err = s.store.UndeleteCharm(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 2)
+	c.Assert(infos[0].Revision(), gc.Equals, 1)
+	c.Assert(infos[0].Deletion().By, gc.Equals, "bob")
+	c.Assert(infos[1].Revision(), gc.Equals, 0)
+	c.Assert(infos[1].Deletion().By, gc.Equals, "alice")
+	info, err = s.store.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 1)
+	c.Assert(info.Deletion(), gc.IsNil)
+	_, err = s.store.UndeleteCharm(url)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestPurgeDeletedCharms(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.SoftDeleteCharm(url, "bob")
+	c.Assert(err, gc.IsNil)
+
+	// Recently deleted charms are kept.
+	purged, err := s.store.PurgeDeletedCharms(time.Hour)
+	c.Assert(err, gc.IsNil)
+	c.Assert(purged, gc.HasLen, 0)
+
+	time.Sleep(10 * time.Millisecond)
+	purged, err = s.store.PurgeDeletedCharms(time.Millisecond)
+	c.Assert(err, gc.IsNil)
+	c.Assert(purged, gc.DeepEquals, []*charm.URL{url.WithRevision(0)})
+	_, err = s.store.UndeleteCharm(url)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	_, err = store.StoreBackend(s.store).OpenBlob(store.CharmInfoBlobId(info))
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestStartPurging(c *gc.C) {
+	s.PatchValue(&store.PurgeInterval, 10*time.Millisecond)
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.SoftDeleteCharm(url, "bob")
+	c.Assert(err, gc.IsNil)
+
+	s.store.StartPurging(time.Millisecond)
+	backend := store.StoreBackend(s.store)
+	for i := 0; ; i++ {
+		docs, err := backend.FindCharms(url, 0, store.IncludeDeleted)
+		c.Assert(err, gc.IsNil)
+		if len(docs) == 0 {
+			break
+		}
+		if i == 500 {
+			c.Fatalf("deleted charm was not purged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *StoreSuite) TestDeleteCharmRecovery(c *gc.C) {
+	urlA := charm.MustParseURL("cs:oneiric/wordpress")
+	urlB := charm.MustParseURL("cs:precise/wordpress")
+
+	// Both charms share the same bundle.
+	var info *store.CharmInfo
+	for _, url := range []*charm.URL{urlA, urlB} {
+		pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+		info, err = s.store.CharmInfo(url)
+		c.Assert(err, gc.IsNil)
+	}
+	id := store.CharmInfoBlobId(info)
+
+	// Simulate a deletion of urlA interrupted after its bundle
+	// was released.
+	backend := store.StoreBackend(s.store)
+	rev := &store.DeleteRevision{Revision: 0, Sha256: info.BundleSha256(), BlobId: id}
+	intent := &store.DeleteIntent{
+		Id:        "some-intent",
+		URL:       urlA,
+		Revisions: []*store.DeleteRevision{rev},
+		Time:      time.Now().Add(-time.Hour),
+	}
+	err := backend.InsertDeleteIntent(intent)
+	c.Assert(err, gc.IsNil)
+	err = backend.RemoveCharm(urlA, 0)
+	c.Assert(err, gc.IsNil)
+	removed, err := backend.UnrefBlob(rev.Sha256, id, store.DeleteIntentToken(intent, rev))
+	c.Assert(err, gc.IsNil)
+	c.Assert(removed, gc.Equals, false)
+
+	// Opening the store again finishes the deletion without
+	// releasing the bundle twice.
+	_, err = store.New(backend)
+	c.Assert(err, gc.IsNil)
+	intents, err := backend.DeleteIntents()
+	c.Assert(err, gc.IsNil)
+	c.Assert(intents, gc.HasLen, 0)
+	_, err = s.store.CharmInfo(urlA)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	_, rc, err := s.store.OpenCharm(urlB)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report, gc.DeepEquals, &store.ScrubReport{Charms: 1})
+
+	// The last reference goes with urlB.
+	_, err = s.store.DeleteCharm(urlB)
+	c.Assert(err, gc.IsNil)
+	_, err = backend.OpenBlob(id)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+func (s *StoreSuite) TestDeleteCharmRecoveryOverlapping(c *gc.C) {
+	urlA := charm.MustParseURL("cs:oneiric/wordpress")
+	urlB := charm.MustParseURL("cs:precise/wordpress")
+
+	// Both charms share the same bundle.
+	infos := make(map[*charm.URL]*store.CharmInfo)
+	for _, url := range []*charm.URL{urlA, urlB} {
+		pub, err := s.store.CharmPublisher([]*charm.URL{url}, "some-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+		infos[url], err = s.store.CharmInfo(url)
+		c.Assert(err, gc.IsNil)
+	}
+	id := store.CharmInfoBlobId(infos[urlA])
+	newIntent := func(intentId string, url *charm.URL, t time.Time) *store.DeleteIntent {
+		info := infos[url]
+		return &store.DeleteIntent{
+			Id:  intentId,
+			URL: url,
+			Revisions: []*store.DeleteRevision{{
+				Revision: 0,
+				Sha256:   info.BundleSha256(),
+				BlobId:   id,
+				Time:     info.Time(),
+			}},
+			Time: t,
+		}
+	}
+
+	// Two abandoned deletions of urlA, of which the first had already
+	// released the bundle.
+	backend := store.StoreBackend(s.store)
+	old := time.Now().Add(-time.Hour)
+	intent1 := newIntent("intent-1", urlA, old)
+	intent2 := newIntent("intent-2", urlA, old)
+	for _, intent := range []*store.DeleteIntent{intent1, intent2} {
+		err := backend.InsertDeleteIntent(intent)
+		c.Assert(err, gc.IsNil)
+	}
+	err := backend.RemoveCharm(urlA, 0)
+	c.Assert(err, gc.IsNil)
+	rev := intent1.Revisions[0]
+	_, err = backend.UnrefBlob(rev.Sha256, id, store.DeleteIntentToken(intent1, rev))
+	c.Assert(err, gc.IsNil)
+
+	// A deletion of urlB that is still running elsewhere.
+	intent3 := newIntent("intent-3", urlB, time.Now())
+	err = backend.InsertDeleteIntent(intent3)
+	c.Assert(err, gc.IsNil)
+
+	// Opening the store again finishes the abandoned deletions,
+	// releasing the bundle of urlA only once, and leaves the running
+	// one alone.
+	_, err = store.New(backend)
+	c.Assert(err, gc.IsNil)
+	intents, err := backend.DeleteIntents()
+	c.Assert(err, gc.IsNil)
+	c.Assert(intents, gc.HasLen, 1)
+	c.Assert(intents[0].Id, gc.Equals, "intent-3")
+	_, rc, err := s.store.OpenCharm(urlB)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rc.Close(), gc.IsNil)
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report, gc.DeepEquals, &store.ScrubReport{Charms: 1})
+
+	// Once it's taken too long, the deletion of urlB is finished too.
+	s.PatchValue(&store.DeleteIntentTimeout, time.Duration(0))
+	_, err = s.store.PurgeDeletedCharms(time.Hour)
+	c.Assert(err, gc.IsNil)
+	intents, err = backend.DeleteIntents()
+	c.Assert(err, gc.IsNil)
+	c.Assert(intents, gc.HasLen, 0)
+	_, err = s.store.CharmInfo(urlB)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	_, err = backend.OpenBlob(id)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+}
+
+// refErrorBackend is a Backend that fails to reference and record
+// blobs.
+type refErrorBackend struct {
+	store.Backend
+}
+
+func (b refErrorBackend) RefBlob(sha256 string) (store.BlobId, error) {
+	return "", fmt.Errorf("cannot reference blob")
+}
+
+func (b refErrorBackend) InsertBlobRef(sha256 string, id store.BlobId) error {
+	return fmt.Errorf("cannot record blob")
+}
+
+func (s *StoreSuite) TestPublishRefErrorLeavesNoBlob(c *gc.C) {
+	backend := store.StoreBackend(s.store)
+	st, err := store.New(refErrorBackend{backend})
+	c.Assert(err, gc.IsNil)
+
+	pub, err := st.CharmPublisher(urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.ErrorMatches, "cannot reference blob")
+	ids, err := backend.BlobIds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ids, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestScrub(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	var ids []store.BlobId
+	for i := 0; i < 2; i++ {
+		pub, err := s.store.CharmPublisher([]*charm.URL{url}, fmt.Sprintf("digest-%d", i))
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+		info, err := s.store.CharmInfo(url.WithRevision(i))
+		c.Assert(err, gc.IsNil)
+		ids = append(ids, store.CharmInfoBlobId(info))
+	}
+
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report, gc.DeepEquals, &store.ScrubReport{Charms: 2})
+
+	backend := store.StoreBackend(s.store)
+
+	// The bundle of revision 0 goes missing.
+	err = backend.RemoveBlob(ids[0])
+	c.Assert(err, gc.IsNil)
+
+	// A charm refers to a bundle with different content.
+	otherURL := charm.MustParseURL("cs:oneiric/mysql")
+	err = backend.InsertCharm(&store.CharmDoc{
+		URLs:   []*charm.URL{otherURL},
+		Sha256: "bogus",
+		Size:   16,
+		FileId: ids[1],
+	}, "")
+	c.Assert(err, gc.IsNil)
+
+	// A bundle no charm refers to.
+	data := []byte("orphan")
+	hash := sha256.Sum256(data)
+	w, err := backend.CreateBlob()
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(data)
+	c.Assert(err, gc.IsNil)
+	orphan, err := w.Finish(hex.EncodeToString(hash[:]))
+	c.Assert(err, gc.IsNil)
+
+	// A reference count that doesn't match.
+	refs, err := backend.BlobRefs()
+	c.Assert(err, gc.IsNil)
+	var badRef *store.BlobRef
+	for _, ref := range refs {
+		if ref.BlobId == ids[1] {
+			badRef = ref
+		}
+	}
+	c.Assert(badRef, gc.NotNil)
+	c.Assert(badRef.Refs, gc.Equals, 1)
+	badRef.Refs = 3
+	err = backend.SetBlobRef(badRef)
+	c.Assert(err, gc.IsNil)
+
+	missing := []*store.ScrubProblem{{
+		URLs:     []*charm.URL{url},
+		Revision: 0,
+		BlobId:   ids[0],
+		Problem:  "bundle not found",
+	}}
+	corrupt := []*store.ScrubProblem{{
+		URLs:     []*charm.URL{otherURL},
+		Revision: 0,
+		BlobId:   ids[1],
+		Problem:  "bundle has hash [0-9a-f]+, expected bogus",
+	}}
+	for _, repair := range []bool{false, true} {
+		report, err = s.store.Scrub(repair)
+		c.Assert(err, gc.IsNil)
+		c.Assert(report.Charms, gc.Equals, 3)
+		c.Assert(report.Missing, gc.DeepEquals, missing)
+		c.Assert(report.Corrupt, gc.HasLen, 1)
+		c.Assert(report.Corrupt[0].Problem, gc.Matches, corrupt[0].Problem)
+		report.Corrupt[0].Problem = corrupt[0].Problem
+		c.Assert(report.Corrupt, gc.DeepEquals, corrupt)
+		c.Assert(report.Orphans, gc.DeepEquals, []store.BlobId{orphan})
+		c.Assert(report.BadRefs, gc.DeepEquals, []*store.BlobRef{{Sha256: badRef.Sha256, BlobId: ids[1], Refs: 1}})
+		c.Assert(report.Repaired, gc.Equals, repair)
+	}
+
+	// Only the problems that need publishing again are left.
+	_, err = backend.OpenBlob(orphan)
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	report, err = s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Missing, gc.HasLen, 1)
+	c.Assert(report.Corrupt, gc.HasLen, 1)
+	c.Assert(report.Orphans, gc.HasLen, 0)
+	c.Assert(report.BadRefs, gc.HasLen, 0)
+}
+
 func (s *StoreSuite) TestCharmPublishError(c *gc.C) {
 	url := charm.MustParseURL("cs:oneiric/wordpress")
 	urls := []*charm.URL{url}
@@ -311,7 +729,7 @@ func (s *StoreSuite) TestLockUpdates(c *gc.C) {
 	lock3.Unlock()
 }
 
-func (s *StoreSuite) TestLockUpdatesExpires(c *gc.C) {
+func (s *MgoStoreSuite) TestLockUpdatesExpires(c *gc.C) {
 	urlA := charm.MustParseURL("cs:oneiric/wordpress-a")
 	urlB := charm.MustParseURL("cs:oneiric/wordpress-b")
 	urls := []*charm.URL{urlA, urlB}
@@ -343,6 +761,158 @@ func (s *StoreSuite) TestLockUpdatesExpires(c *gc.C) {
 	c.Check(lock3, gc.IsNil)
 }
 
+func (s *StoreSuite) TestLockFence(c *gc.C) {
+	lock1, err := s.store.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	pub, err := lock1.CharmPublisher("some-digest")
+	c.Assert(err, gc.IsNil)
+
+	// The lock expires and is acquired by another publisher.
+	backend := store.StoreBackend(s.store)
+	for _, url := range urls {
+		err = backend.ExpireLock(url.String(), time.Now().Add(time.Hour))
+		c.Assert(err, gc.IsNil)
+	}
+	lock2, err := s.store.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	defer lock2.Unlock()
+
+	// The stale holder can't publish anymore, and leaves nothing
+	// behind.
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.Equals, store.ErrUpdateConflict)
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	report, err := s.store.Scrub(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Orphans, gc.HasLen, 0)
+	c.Assert(report.BadRefs, gc.HasLen, 0)
+
+	// Nor can it release the new lock, no matter how often it tries.
+	lock1.Unlock()
+	lock1.Unlock()
+	_, err = s.store.LockUpdates(urls)
+	c.Assert(err, gc.Equals, store.ErrUpdateConflict)
+}
+
+func (s *StoreSuite) TestLockFenceBroken(c *gc.C) {
+	lock, err := s.store.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+	pub, err := lock.CharmPublisher("some-digest")
+	c.Assert(err, gc.IsNil)
+
+	// The lock over a single URL is forcefully released.
+	err = s.store.BreakLock(urls[1].String())
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.Equals, store.ErrUpdateConflict)
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// The backend refuses charms for locks not held.
+	backend := store.StoreBackend(s.store)
+	err = backend.InsertCharm(&store.CharmDoc{URLs: urls[:1]}, "bogus-token")
+	c.Assert(err, gc.Equals, store.ErrUpdateConflict)
+}
+
+func (s *MgoStoreSuite) TestLockFenceStalePending(c *gc.C) {
+	// A publisher went away while inserting its charm, leaving it
+	// pending.
+	charms := s.Session.DB("juju").C("charms")
+	err := charms.Insert(bson.M{"urls": urls, "revision": 0, "locktoken": "stale-token"})
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+
+	// The next lock holder takes over the revision.
+	lock, err := s.store.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+	pub, err := lock.CharmPublisher("some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Digest(), gc.Equals, "some-digest")
+	n, err := charms.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *MgoStoreSuite) TestLockRenewal(c *gc.C) {
+	s.PatchValue(&store.LockRenewInterval, 10*time.Millisecond)
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	lock, err := s.store.LockUpdates([]*charm.URL{url})
+	c.Assert(err, gc.IsNil)
+
+	locks := s.Session.DB("juju").C("locks")
+	var doc store.LockDoc
+	err = locks.FindId(url.String()).One(&doc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(doc.Owner, gc.Equals, store.LockOwner)
+	c.Assert(doc.Token, gc.Not(gc.Equals), "")
+	c.Assert(doc.Time.Equal(doc.Acquired), gc.Equals, true)
+
+	// Make the lock look old. It gets renewed before it may expire.
+	old := bson.Now().Add(-store.UpdateTimeout + 10e9)
+	err = locks.UpdateId(url.String(), bson.M{"$set": bson.M{"time": old}})
+	c.Assert(err, gc.IsNil)
+	for i := 0; ; i++ {
+		err = locks.FindId(url.String()).One(&doc)
+		c.Assert(err, gc.IsNil)
+		if doc.Time.After(old) {
+			break
+		}
+		if i == 500 {
+			c.Fatalf("lock was not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Unlock()
+	n, err := locks.Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestLocksAndBreakLock(c *gc.C) {
+	locks, err := s.store.Locks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locks, gc.HasLen, 0)
+
+	before := bson.Now()
+	lock, err := s.store.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+
+	locks, err = s.store.Locks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locks, gc.HasLen, 2)
+	c.Assert(locks[0].Key, gc.Equals, "cs:oneiric/dummy")
+	c.Assert(locks[1].Key, gc.Equals, "cs:~joe/oneiric/dummy")
+	for _, l := range locks {
+		c.Assert(l.Owner, gc.Equals, store.LockOwner)
+		c.Assert(l.Token, gc.Equals, locks[0].Token)
+		c.Assert(l.Acquired.Before(before), gc.Equals, false)
+	}
+
+	err = s.store.BreakLock("cs:oneiric/dummy")
+	c.Assert(err, gc.IsNil)
+	err = s.store.BreakLock("cs:oneiric/dummy")
+	c.Assert(err, gc.Equals, store.ErrNotFound)
+	locks, err = s.store.Locks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locks, gc.HasLen, 1)
+
+	// The broken lock may be acquired by someone else.
+	lock2, err := s.store.LockUpdates(urls[1:])
+	c.Assert(err, gc.IsNil)
+	lock2.Unlock()
+}
+
 var seriesSolverCharms = []struct {
 	series, name string
 }{
@@ -541,7 +1111,7 @@ func (s *StoreSuite) TestLogCharmEventWithRevisionedURL(c *gc.C) {
 	c.Assert(event, gc.IsNil)
 }
 
-func (s *StoreSuite) TestLogCharmEvent(c *gc.C) {
+func (s *MgoStoreSuite) TestLogCharmEvent(c *gc.C) {
 	url1 := charm.MustParseURL("cs:oneiric/wordpress")
 	url2 := charm.MustParseURL("cs:oneiric/mysql")
 	urls := []*charm.URL{url1, url2}
@@ -608,11 +1178,7 @@ func (s *StoreSuite) TestLogCharmEvent(c *gc.C) {
 	c.Assert(event, gc.IsNil)
 }
 
-func (s *StoreSuite) TestSumCounters(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
+func (s *MgoStoreSuite) TestSumCounters(c *gc.C) {
 	req := store.CounterRequest{Key: []string{"a"}}
 	cs, err := s.store.Counters(&req)
 	c.Assert(err, gc.IsNil)
@@ -685,11 +1251,7 @@ func (s *StoreSuite) TestSumCounters(c *gc.C) {
 	c.Assert(cs, gc.DeepEquals, []store.Counter{{Key: req.Key, Prefix: true, Count: 21}})
 }
 
-func (s *StoreSuite) TestCountersReadOnlySum(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
+func (s *MgoStoreSuite) TestCountersReadOnlySum(c *gc.C) {
 	// Summing up an unknown key shouldn't add the key to the database.
 	req := store.CounterRequest{Key: []string{"a", "b", "c"}}
 	_, err := s.store.Counters(&req)
@@ -701,11 +1263,7 @@ func (s *StoreSuite) TestCountersReadOnlySum(c *gc.C) {
 	c.Assert(n, gc.Equals, 0)
 }
 
-func (s *StoreSuite) TestCountersTokenCaching(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
+func (s *MgoStoreSuite) TestCountersTokenCaching(c *gc.C) {
 	assertSum := func(i int, want int64) {
 		req := store.CounterRequest{Key: []string{strconv.Itoa(i)}}
 		cs, err := s.store.Counters(&req)
@@ -761,10 +1319,6 @@ func (s *StoreSuite) TestCountersTokenCaching(c *gc.C) {
 }
 
 func (s *StoreSuite) TestCounterTokenUniqueness(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
 	var wg0, wg1 sync.WaitGroup
 	wg0.Add(10)
 	wg1.Add(10)
@@ -785,11 +1339,60 @@ func (s *StoreSuite) TestCounterTokenUniqueness(c *gc.C) {
 	c.Assert(cs[0].Count, gc.Equals, int64(10))
 }
 
-func (s *StoreSuite) TestListCounters(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
+func (s *StoreSuite) TestIncCounterAsync(c *gc.C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.store.IncCounterAsync([]string{"a", "b"})
+			}
+		}()
+	}
+	wg.Wait()
+	s.store.IncCounterAsync(nil)
+	s.checkCounterSum(c, []string{"a", "b"}, false, 100)
+	c.Assert(s.store.CounterWriterStats(), gc.DeepEquals, store.CounterWriterStats{Recorded: 100})
+}
+
+func (s *StoreSuite) TestCounterWriterLimits(c *gc.C) {
+	s.PatchValue(&store.StatsFlushInterval, time.Hour)
+	s.PatchValue(&store.StatsFlushSize, 3)
+	s.PatchValue(&store.StatsMaxPending, 2)
+
+	// Increments of pending counters are merged, and other counters
+	// are dropped once too many are pending.
+	for i := 0; i < 3; i++ {
+		s.store.IncCounterAsync([]string{"a"})
+		s.store.IncCounterAsync([]string{"b"})
+		s.store.IncCounterAsync([]string{"c"})
+	}
+	c.Assert(s.store.CounterWriterStats(), gc.DeepEquals, store.CounterWriterStats{Pending: 2, Dropped: 3})
+
+	// Closing the store records the pending increments.
+	s.store.Close()
+	c.Assert(s.store.CounterWriterStats(), gc.DeepEquals, store.CounterWriterStats{Recorded: 6, Dropped: 3})
+	s.store = nil
+}
+
+func (s *StoreSuite) TestCounterWriterFlushSize(c *gc.C) {
+	s.PatchValue(&store.StatsFlushInterval, time.Hour)
+	s.PatchValue(&store.StatsFlushSize, 2)
+
+	s.store.IncCounterAsync([]string{"a"})
+	c.Assert(s.store.CounterWriterStats().Pending, gc.Equals, 1)
+	s.store.IncCounterAsync([]string{"b"})
+	for i := 0; i < 100; i++ {
+		if s.store.CounterWriterStats().Recorded == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	c.Fatalf("pending counters not recorded: %#v", s.store.CounterWriterStats())
+}
 
+func (s *MgoStoreSuite) TestListCounters(c *gc.C) {
 	incs := [][]string{
 		{"c", "b", "a"}, // Assign internal id c < id b < id a, to make sorting slightly trickier.
 		{"a"},
@@ -850,11 +1453,7 @@ func (s *StoreSuite) TestListCounters(c *gc.C) {
 	}
 }
 
-func (s *StoreSuite) TestListCountersBy(c *gc.C) {
-	if *noTestMongoJs {
-		c.Skip("MongoDB javascript not available")
-	}
-
+func (s *MgoStoreSuite) TestListCountersBy(c *gc.C) {
 	incs := []struct {
 		key []string
 		day int
@@ -999,6 +1598,147 @@ func (s *StoreSuite) TestListCountersBy(c *gc.C) {
 	}
 }
 
+// fillCounters records counters for the given number of charms in each
+// of the minutes stamps, spread over several weeks, unless they are
+// already recorded.
+func (s *StoreSuite) fillCounters(c *gc.C, charms, stamps int) {
+	req := store.CounterRequest{Key: []string{"charm-bundle"}, Prefix: true}
+	cs, err := s.store.Counters(&req)
+	c.Assert(err, gc.IsNil)
+	if cs[0].Count > 0 {
+		return
+	}
+	start := time.Date(2012, time.May, 1, 0, 0, 0, 0, time.UTC)
+	series := []string{"oneiric", "precise", "trusty"}
+	backend := store.StoreBackend(s.store)
+	for i := 0; i < charms; i++ {
+		key := []string{"charm-bundle", series[i%len(series)], fmt.Sprintf("charm-%d", i)}
+		incs := make([]store.CounterInc, stamps)
+		for j := range incs {
+			incs[j] = store.CounterInc{
+				Key:   key,
+				Time:  start.Add(time.Duration(j*(i+37)) * time.Minute),
+				Count: int64(1 + (i+j)%5),
+			}
+		}
+		err := backend.IncCounters(incs)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+var countersRequests = []store.CounterRequest{
+	{Key: []string{"charm-bundle"}},
+	{Key: []string{"charm-bundle"}, Prefix: true},
+	{Key: []string{"charm-bundle"}, Prefix: true, List: true},
+	{Key: []string{"charm-bundle", "precise"}, Prefix: true, List: true},
+	{Key: []string{"charm-bundle", "oneiric", "charm-3"}},
+	{Key: []string{"charm-bundle", "oneiric", "charm-3"}, By: store.ByDay},
+	{Key: []string{"charm-bundle"}, Prefix: true, By: store.ByDay},
+	{Key: []string{"charm-bundle"}, Prefix: true, By: store.ByWeek},
+	{Key: []string{"charm-bundle"}, Prefix: true, List: true, By: store.ByDay},
+	{Key: []string{"charm-bundle"}, Prefix: true, List: true, By: store.ByWeek},
+	{
+		Key:    []string{"charm-bundle"},
+		Prefix: true,
+		List:   true,
+		By:     store.ByDay,
+		Start:  time.Date(2012, time.May, 3, 0, 0, 0, 0, time.UTC),
+		Stop:   time.Date(2012, time.May, 10, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+func (s *StoreSuite) TestCountersMatchMapReduce(c *gc.C) {
+	if *noTestMongoJs {
+		c.Skip("MongoDB javascript not available")
+	}
+	if _, ok, _ := store.CountersMapReduce(s.store, &countersRequests[0]); !ok {
+		c.Skip("map-reduce requires a MongoDB backend")
+	}
+	s.fillCounters(c, 10, 200)
+	for i, req := range countersRequests {
+		c.Logf("test %d: %#v", i, req)
+		expected, _, err := store.CountersMapReduce(s.store, &req)
+		c.Assert(err, gc.IsNil)
+		result, err := s.store.Counters(&req)
+		c.Assert(err, gc.IsNil)
+		c.Assert(result, gc.DeepEquals, expected)
+	}
+}
+
+func (s *StoreSuite) benchmarkCounters(c *gc.C, req store.CounterRequest, mapReduce bool) {
+	if mapReduce {
+		if *noTestMongoJs {
+			c.Skip("MongoDB javascript not available")
+		}
+		if _, ok, _ := store.CountersMapReduce(s.store, &req); !ok {
+			c.Skip("map-reduce requires a MongoDB backend")
+		}
+	}
+	s.fillCounters(c, 100, 1000)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		var err error
+		if mapReduce {
+			_, _, err = store.CountersMapReduce(s.store, &req)
+		} else {
+			_, err = s.store.Counters(&req)
+		}
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+var (
+	benchSumRequest    = store.CounterRequest{Key: []string{"charm-bundle"}, Prefix: true}
+	benchListRequest   = store.CounterRequest{Key: []string{"charm-bundle"}, Prefix: true, List: true}
+	benchByWeekRequest = store.CounterRequest{Key: []string{"charm-bundle"}, Prefix: true, List: true, By: store.ByWeek}
+)
+
+func (s *StoreSuite) BenchmarkCountersSum(c *gc.C) {
+	s.benchmarkCounters(c, benchSumRequest, false)
+}
+
+func (s *StoreSuite) BenchmarkCountersSumMapReduce(c *gc.C) {
+	s.benchmarkCounters(c, benchSumRequest, true)
+}
+
+func (s *StoreSuite) BenchmarkCountersList(c *gc.C) {
+	s.benchmarkCounters(c, benchListRequest, false)
+}
+
+func (s *StoreSuite) BenchmarkCountersListMapReduce(c *gc.C) {
+	s.benchmarkCounters(c, benchListRequest, true)
+}
+
+func (s *StoreSuite) BenchmarkCountersListByWeek(c *gc.C) {
+	s.benchmarkCounters(c, benchByWeekRequest, false)
+}
+
+func (s *StoreSuite) BenchmarkCountersListByWeekMapReduce(c *gc.C) {
+	s.benchmarkCounters(c, benchByWeekRequest, true)
+}
+
+func (s *StoreSuite) TestSyncTime(c *gc.C) {
+	t, err := s.store.SyncTime("some-sync")
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.IsZero(), gc.Equals, true)
+
+	now := time.Unix(time.Now().Unix(), 0)
+	err = s.store.SetSyncTime("some-sync", now)
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetSyncTime("other-sync", now.Add(-time.Hour))
+	c.Assert(err, gc.IsNil)
+	t, err = s.store.SyncTime("some-sync")
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.Equal(now), gc.Equals, true)
+
+	// The zero time resets the sync.
+	err = s.store.SetSyncTime("some-sync", time.Time{})
+	c.Assert(err, gc.IsNil)
+	t, err = s.store.SyncTime("some-sync")
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.IsZero(), gc.Equals, true)
+}
+
 func (s *TrivialSuite) TestEventString(c *gc.C) {
 	c.Assert(store.EventPublished, gc.Matches, "published")
 	c.Assert(store.EventPublishError, gc.Matches, "publish-error")